@@ -0,0 +1,223 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package accounting
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"chloe/def"
+	"chloe/util"
+)
+
+const (
+	KindChat          = "chat"
+	KindImage         = "image"
+	KindTranscription = "transcription"
+)
+
+// Record is what one request to an AI backend used
+type Record struct {
+	Time             time.Time  `json:"time"`
+	UserID           def.UserID `json:"userId"`
+	ChatID           def.ChatID `json:"chatId"`
+	Kind             string     `json:"kind"`
+	Model            string     `json:"model"`
+	PromptTokens     int        `json:"promptTokens,omitempty"`
+	CompletionTokens int        `json:"completionTokens,omitempty"`
+	AudioSeconds     float64    `json:"audioSeconds,omitempty"`
+	Images           int        `json:"images,omitempty"`
+	ImageSize        string     `json:"imageSize,omitempty"`
+	Cost             float64    `json:"cost"`
+}
+
+type Summary struct {
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	AudioSeconds     float64
+	Images           int
+	Cost             float64
+}
+
+func (sum *Summary) Add(rec Record) {
+	sum.Requests++
+	sum.PromptTokens += rec.PromptTokens
+	sum.CompletionTokens += rec.CompletionTokens
+	sum.AudioSeconds += rec.AudioSeconds
+	sum.Images += rec.Images
+	sum.Cost += rec.Cost
+}
+
+// Store appends records as json lines to a file, queries scan the whole file
+// which is fine for the volume of a chat bot
+type Store struct {
+	guard   sync.Mutex
+	path    string
+	pricing util.Pricing
+}
+
+func NewStore(path string, pricing util.Pricing) *Store {
+	return &Store{
+		path:    path,
+		pricing: pricing,
+	}
+}
+
+func (st *Store) Currency() string {
+	if st.pricing.Currency == "" {
+		return "USD"
+	}
+	return st.pricing.Currency
+}
+
+// Price calculates the cost of the record with the configured price table,
+// unknown models and sizes cost nothing
+func (st *Store) Price(rec Record) float64 {
+	switch rec.Kind {
+	case KindChat:
+		price := st.pricing.Models[rec.Model]
+		return float64(rec.PromptTokens)/1000*price.Prompt +
+			float64(rec.CompletionTokens)/1000*price.Completion
+	case KindTranscription:
+		return rec.AudioSeconds / 60 * st.pricing.AudioPerMinute[rec.Model]
+	case KindImage:
+		return float64(rec.Images) * st.pricing.Images[rec.ImageSize]
+	default:
+		return 0
+	}
+}
+
+// Record prices and saves the record, the saved record is returned
+func (st *Store) Record(rec Record) Record {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Cost = st.Price(rec)
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("failed to marshal usage record", "err", err)
+		return rec
+	}
+
+	st.guard.Lock()
+	defer st.guard.Unlock()
+
+	f, err := os.OpenFile(st.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		slog.Error("failed to open usage file", "path", st.path, "err", err)
+		return rec
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write usage record", "path", st.path, "err", err)
+	}
+	return rec
+}
+
+// Query returns the records in [from, to) that pass the filter, filter can be nil
+func (st *Store) Query(from, to time.Time, filter func(Record) bool) ([]Record, error) {
+	st.guard.Lock()
+	defer st.guard.Unlock()
+
+	f, err := os.Open(st.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			slog.Warn("bad usage record skipped", "path", st.path, "err", err)
+			continue
+		}
+		if rec.Time.Before(from) || !rec.Time.Before(to) {
+			continue
+		}
+		if filter == nil || filter(rec) {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Summarize groups the records by key
+func Summarize(records []Record, key func(Record) string) map[string]*Summary {
+	sums := make(map[string]*Summary)
+	for _, rec := range records {
+		k := key(rec)
+		sum, exists := sums[k]
+		if !exists {
+			sum = &Summary{}
+			sums[k] = sum
+		}
+		sum.Add(rec)
+	}
+	return sums
+}
+
+// SortedKeys returns the keys of the summaries, the most expensive first
+func SortedKeys(sums map[string]*Summary) []string {
+	var keys []string
+	for k := range sums {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if sums[keys[i]].Cost != sums[keys[j]].Cost {
+			return sums[keys[i]].Cost > sums[keys[j]].Cost
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func WriteCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	header := []string{
+		"time", "user_id", "chat_id", "kind", "model",
+		"prompt_tokens", "completion_tokens", "audio_seconds", "images", "image_size", "cost",
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		row := []string{
+			rec.Time.Format(time.RFC3339),
+			rec.UserID.String(),
+			rec.ChatID.String(),
+			rec.Kind,
+			rec.Model,
+			strconv.Itoa(rec.PromptTokens),
+			strconv.Itoa(rec.CompletionTokens),
+			strconv.FormatFloat(rec.AudioSeconds, 'f', 1, 64),
+			strconv.Itoa(rec.Images),
+			rec.ImageSize,
+			strconv.FormatFloat(rec.Cost, 'f', 6, 64),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,438 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"chloe/def"
+	"chloe/util"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleGuest  = "guest"
+	RoleBanned = "banned"
+
+	// matches every permission in allow and deny lists
+	allPermissions = "*"
+	// defaults key for ids of any adapter
+	anyNamespace = "*"
+)
+
+var knownPermissions = []def.Permission{
+	def.PermChat,
+	def.PermDraw,
+	def.PermVoice,
+	def.PermTTS,
+	def.PermModel,
+	def.PermAdmin,
+}
+
+// builtin roles, acl.yml can redefine them or add more
+var builtinRoles = map[string]RoleDef{
+	RoleAdmin:  {Allow: []def.Permission{allPermissions}},
+	RoleMember: {Allow: []def.Permission{def.PermChat, def.PermDraw, def.PermVoice, def.PermTTS}},
+	RoleGuest:  {Allow: []def.Permission{def.PermChat}},
+	RoleBanned: {Deny: []def.Permission{allPermissions}},
+}
+
+type RoleDef struct {
+	Allow []def.Permission `yaml:"allow,omitempty"`
+	Deny  []def.Permission `yaml:"deny,omitempty"`
+}
+
+// Policy is the content of acl.yml
+type Policy struct {
+	Roles map[string]RoleDef `yaml:"roles,omitempty"`
+	// role of ids not assigned below, by adapter namespace like tg or rm, "*" for any
+	Defaults map[string]string `yaml:"defaults,omitempty"`
+	Users    map[string]string `yaml:"users,omitempty"`
+	Chats    map[string]string `yaml:"chats,omitempty"`
+	// permissions denied to single users or chats whatever their role is
+	Deny map[string][]def.Permission `yaml:"deny,omitempty"`
+	// Groups names sets of user and chat ids, for example to give them other quotas
+	Groups map[string][]string `yaml:"groups,omitempty"`
+
+	// the boolean maps of old acl.yml files, converted to roles on load
+	LegacyAllowedUserID map[string]bool `yaml:"allowedUserID,omitempty"`
+	LegacyAllowedChatID map[string]bool `yaml:"allowedChatID,omitempty"`
+	LegacyAdminUserID   map[string]bool `yaml:"adminUserID,omitempty"`
+
+	// the defaults come from allow_all of an old acl file, which let everyone in
+	// whatever whitelistEnabled said
+	legacyAllowAll bool
+}
+
+// AccessControl answers what a user may do in a chat. A user gets the permissions
+// of the user's role and of the chat's role, and any deny wins over any allow.
+type AccessControl struct {
+	guard sync.RWMutex
+	// the acl file with the changes applied
+	policy Policy
+	// the acl file as it was read
+	file Policy
+	// made by admins while the bot runs
+	changes overlay
+	// the file the acl is read from
+	path string
+	// changes, audit log and invite codes, empty to keep changes in memory
+	// and disable the rest
+	dataDir string
+	// only assigned users and chats have a role, defaults are ignored
+	whitelist bool
+}
+
+func New(policy Policy) (*AccessControl, error) {
+	convertLegacy(&policy)
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return &AccessControl{
+		policy: policy,
+		file:   policy,
+	}, nil
+}
+
+func Load(path string) (*AccessControl, error) {
+	policy, err := readPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessControl{
+		policy: policy,
+		file:   policy,
+		path:   path,
+	}, nil
+}
+
+// Reload reads the acl file again and applies the changes on it, the running
+// policy stays if the file is invalid
+func (acl *AccessControl) Reload() error {
+	if acl.path == "" {
+		return errors.New("acl is not loaded from a file")
+	}
+	file, err := readPolicy(acl.path)
+	if err != nil {
+		return err
+	}
+
+	acl.guard.Lock()
+	defer acl.guard.Unlock()
+
+	policy := acl.changes.apply(file)
+	if err := policy.Validate(); err != nil {
+		return fmt.Errorf("with the changes in %s, %v", acl.changesPath(), err)
+	}
+	acl.file, acl.policy = file, policy
+	return nil
+}
+
+// Path is the file the acl is loaded from
+func (acl *AccessControl) Path() string {
+	return acl.path
+}
+
+func readPolicy(path string) (Policy, error) {
+	var policy Policy
+	aclFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return policy, err
+	}
+	if err := yaml.Unmarshal(aclFile, &policy); err != nil {
+		return policy, err
+	}
+	convertLegacy(&policy)
+	if err := policy.Validate(); err != nil {
+		return policy, err
+	}
+	return policy, nil
+}
+
+func (acl *AccessControl) SetWhitelist(enabled bool) {
+	acl.guard.Lock()
+	defer acl.guard.Unlock()
+
+	acl.whitelist = enabled
+}
+
+func (acl *AccessControl) HasPermission(uid def.UserID, cid def.ChatID, perm def.Permission) bool {
+	if perm == "" {
+		return true
+	}
+
+	acl.guard.RLock()
+	defer acl.guard.RUnlock()
+
+	roles := []RoleDef{
+		acl.roleDef(acl.userRole(uid.String())),
+		acl.roleDef(acl.chatRole(cid.String())),
+	}
+
+	if matches(acl.policy.Deny[uid.String()], perm) || matches(acl.policy.Deny[cid.String()], perm) {
+		return false
+	}
+	for _, role := range roles {
+		if matches(role.Deny, perm) {
+			return false
+		}
+	}
+	for _, role := range roles {
+		if matches(role.Allow, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *AccessControl) IsAdmin(uid def.UserID) bool {
+	acl.guard.RLock()
+	defer acl.guard.RUnlock()
+
+	role := acl.roleDef(acl.userRole(uid.String()))
+	return !matches(acl.policy.Deny[uid.String()], def.PermAdmin) &&
+		!matches(role.Deny, def.PermAdmin) &&
+		matches(role.Allow, def.PermAdmin)
+}
+
+// Admins returns the users assigned a role with the admin permission
+func (acl *AccessControl) Admins() []def.UserID {
+	acl.guard.RLock()
+	defer acl.guard.RUnlock()
+
+	var admins []def.UserID
+	for id, role := range acl.policy.Users {
+		rd := acl.roleDef(role)
+		if matches(rd.Allow, def.PermAdmin) && !matches(rd.Deny, def.PermAdmin) &&
+			!matches(acl.policy.Deny[id], def.PermAdmin) {
+			admins = append(admins, def.UserID(id))
+		}
+	}
+	sort.Slice(admins, func(i, j int) bool { return admins[i] < admins[j] })
+	return admins
+}
+
+func (acl *AccessControl) UserRole(uid def.UserID) string {
+	acl.guard.RLock()
+	defer acl.guard.RUnlock()
+
+	return acl.userRole(uid.String())
+}
+
+func (acl *AccessControl) ChatRole(cid def.ChatID) string {
+	acl.guard.RLock()
+	defer acl.guard.RUnlock()
+
+	return acl.chatRole(cid.String())
+}
+
+// GroupOf returns the first group by name that lists the id,
+// otherwise the role of the id, so quotas can be set per role as well
+func (acl *AccessControl) GroupOf(id string) string {
+	acl.guard.RLock()
+	defer acl.guard.RUnlock()
+
+	var names []string
+	for name := range acl.policy.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, member := range acl.policy.Groups[name] {
+			if member == id {
+				return name
+			}
+		}
+	}
+	if role, exists := acl.policy.Users[id]; exists {
+		return role
+	}
+	if role, exists := acl.policy.Chats[id]; exists {
+		return role
+	}
+	if role := acl.defaultRole(id); role != "" {
+		return role
+	}
+	return util.DefaultGroup
+}
+
+func (acl *AccessControl) userRole(id string) string {
+	if role, exists := acl.policy.Users[id]; exists {
+		return role
+	}
+	return acl.defaultRole(id)
+}
+
+func (acl *AccessControl) chatRole(id string) string {
+	if role, exists := acl.policy.Chats[id]; exists {
+		return role
+	}
+	return acl.defaultRole(id)
+}
+
+func (acl *AccessControl) defaultRole(id string) string {
+	if acl.whitelist && !acl.policy.legacyAllowAll {
+		return ""
+	}
+	if role, exists := acl.policy.Defaults[namespaceOf(id)]; exists {
+		return role
+	}
+	return acl.policy.Defaults[anyNamespace]
+}
+
+func (acl *AccessControl) roleDef(role string) RoleDef {
+	if rd, exists := acl.policy.Roles[role]; exists {
+		return rd
+	}
+	return builtinRoles[role]
+}
+
+// Validate checks that ids carry an adapter namespace and roles and permissions exist
+func (p *Policy) Validate() error {
+	var errs []string
+	roleExists := func(role string) bool {
+		_, custom := p.Roles[role]
+		_, builtin := builtinRoles[role]
+		return custom || builtin
+	}
+
+	for name, rd := range p.Roles {
+		for _, perm := range append(append([]def.Permission{}, rd.Allow...), rd.Deny...) {
+			if !validPermission(perm) {
+				errs = append(errs, fmt.Sprintf("role %s: unknown permission '%s'", name, perm))
+			}
+		}
+	}
+	for ns, role := range p.Defaults {
+		if ns != anyNamespace && !validNamespace(ns) {
+			errs = append(errs, fmt.Sprintf("defaults: unknown namespace '%s'", ns))
+		}
+		if role != "" && !roleExists(role) {
+			errs = append(errs, fmt.Sprintf("defaults: unknown role '%s' for %s", role, ns))
+		}
+	}
+	for section, assignments := range map[string]map[string]string{"users": p.Users, "chats": p.Chats} {
+		for id, role := range assignments {
+			if !validNamespace(namespaceOf(id)) {
+				errs = append(errs, fmt.Sprintf("%s: id '%s' has no namespace like tg- or rm-", section, id))
+			}
+			if !roleExists(role) {
+				errs = append(errs, fmt.Sprintf("%s: unknown role '%s' for %s", section, role, id))
+			}
+		}
+	}
+	for id, perms := range p.Deny {
+		if !validNamespace(namespaceOf(id)) {
+			errs = append(errs, fmt.Sprintf("deny: id '%s' has no namespace like tg- or rm-", id))
+		}
+		for _, perm := range perms {
+			if !validPermission(perm) {
+				errs = append(errs, fmt.Sprintf("deny: unknown permission '%s' for %s", perm, id))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid acl: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// convertLegacy turns the allowedUserID, allowedChatID and adminUserID maps
+// of old acl files into role assignments
+func convertLegacy(p *Policy) {
+	if p.LegacyAllowedUserID == nil && p.LegacyAllowedChatID == nil && p.LegacyAdminUserID == nil {
+		return
+	}
+	slog.Warn("acl.yml uses allowedUserID/allowedChatID, converted to roles, please migrate")
+
+	if p.Users == nil {
+		p.Users = make(map[string]string)
+	}
+	if p.Chats == nil {
+		p.Chats = make(map[string]string)
+	}
+	if p.Defaults == nil {
+		p.Defaults = make(map[string]string)
+	}
+	convert := func(legacy map[string]bool, assignments map[string]string) {
+		for id, allowed := range legacy {
+			switch {
+			case id == "allow_all":
+				if allowed {
+					p.Defaults[anyNamespace] = RoleMember
+					p.legacyAllowAll = true
+					slog.Warn("acl.yml has allow_all: true, everyone is a member even with whitelistEnabled, " +
+						"remove it and assign roles to keep strangers out")
+				}
+			case !validNamespace(namespaceOf(id)):
+				// placeholders like add_your_id_here
+			case allowed:
+				assignments[id] = RoleMember
+			default:
+				// false only meant not allowed by this map, the id may still
+				// get in by the other map or allow_all, so it gets no role
+			}
+		}
+	}
+	convert(p.LegacyAllowedUserID, p.Users)
+	convert(p.LegacyAllowedChatID, p.Chats)
+	for id, admin := range p.LegacyAdminUserID {
+		if admin && validNamespace(namespaceOf(id)) {
+			p.Users[id] = RoleAdmin
+		}
+	}
+	p.LegacyAllowedUserID, p.LegacyAllowedChatID, p.LegacyAdminUserID = nil, nil, nil
+}
+
+func matches(perms []def.Permission, perm def.Permission) bool {
+	for _, p := range perms {
+		if p == perm || p == allPermissions {
+			return true
+		}
+	}
+	return false
+}
+
+func validPermission(perm def.Permission) bool {
+	if perm == allPermissions {
+		return true
+	}
+	for _, p := range knownPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceOf returns the adapter namespace of an id, tg for tg-123
+func namespaceOf(id string) string {
+	ns, _, found := strings.Cut(id, "-")
+	if !found {
+		return ""
+	}
+	return ns
+}
+
+func validNamespace(ns string) bool {
+	for _, prefix := range def.IDPrefixes {
+		if prefix == ns+"-" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package acl
+
+import (
+	"testing"
+
+	"chloe/def"
+)
+
+func newTestACL(t *testing.T, policy Policy) *AccessControl {
+	t.Helper()
+	acl, err := New(policy)
+	if err != nil {
+		t.Fatalf("new acl: %v", err)
+	}
+	return acl
+}
+
+func TestRoleResolution(t *testing.T) {
+	acl := newTestACL(t, Policy{
+		Roles: map[string]RoleDef{
+			"reader": {Allow: []def.Permission{def.PermChat}, Deny: []def.Permission{def.PermDraw}},
+		},
+		Defaults: map[string]string{"tg": RoleGuest, anyNamespace: RoleMember},
+		Users: map[string]string{
+			"tg-1": RoleAdmin,
+			"tg-2": RoleBanned,
+			"tg-3": "reader",
+		},
+		Chats: map[string]string{"tg--100": RoleMember},
+		Deny:  map[string][]def.Permission{"tg-4": {def.PermChat}},
+	})
+
+	for _, c := range []struct {
+		uid  def.UserID
+		cid  def.ChatID
+		perm def.Permission
+		want bool
+	}{
+		{"tg-1", "tg-1", def.PermAdmin, true},
+		{"tg-1", "tg-1", def.PermModel, true},
+		// banned denies everything, also in a member chat
+		{"tg-2", "tg-2", def.PermChat, false},
+		{"tg-2", "tg--100", def.PermChat, false},
+		// the user's role and the chat's role add up
+		{"tg-5", "tg-5", def.PermDraw, false},
+		{"tg-5", "tg--100", def.PermDraw, true},
+		// a deny of the role wins over an allow of the chat
+		{"tg-3", "tg--100", def.PermDraw, false},
+		{"tg-3", "tg--100", def.PermChat, true},
+		// a deny of the id wins over every role
+		{"tg-4", "tg--100", def.PermChat, false},
+		{"tg-4", "tg--100", def.PermVoice, true},
+		// defaults by namespace, "*" for the others
+		{"tg-5", "tg-5", def.PermChat, true},
+		{"rm-5", "rm-5", def.PermVoice, true},
+		{"rm-5", "rm-5", def.PermAdmin, false},
+		// no permission needed
+		{"tg-2", "tg-2", "", true},
+	} {
+		if got := acl.HasPermission(c.uid, c.cid, c.perm); got != c.want {
+			t.Errorf("%s in %s %s: got %v, want %v", c.uid, c.cid, c.perm, got, c.want)
+		}
+	}
+
+	if !acl.IsAdmin("tg-1") || acl.IsAdmin("tg-3") {
+		t.Error("only tg-1 should be admin")
+	}
+	if admins := acl.Admins(); len(admins) != 1 || admins[0] != "tg-1" {
+		t.Errorf("admins: got %v, want [tg-1]", admins)
+	}
+	if role := acl.UserRole("tg-9"); role != RoleGuest {
+		t.Errorf("default role of tg-9: got %q, want guest", role)
+	}
+}
+
+func TestWhitelist(t *testing.T) {
+	acl := newTestACL(t, Policy{
+		Defaults: map[string]string{anyNamespace: RoleMember},
+		Users:    map[string]string{"tg-1": RoleMember},
+	})
+	acl.SetWhitelist(true)
+
+	if !acl.HasPermission("tg-1", "tg-1", def.PermChat) {
+		t.Error("listed user denied with the whitelist on")
+	}
+	if acl.HasPermission("tg-2", "tg-2", def.PermChat) {
+		t.Error("unlisted user allowed by the defaults with the whitelist on")
+	}
+}
+
+func TestConvertLegacy(t *testing.T) {
+	p := Policy{
+		LegacyAllowedUserID: map[string]bool{
+			"tg-1":             true,
+			"tg-2":             false,
+			"add_your_id_here": true,
+		},
+		LegacyAllowedChatID: map[string]bool{
+			"tg--100": true,
+			"tg--200": false,
+		},
+		LegacyAdminUserID: map[string]bool{
+			"tg-3": true,
+			"tg-4": false,
+		},
+	}
+	convertLegacy(&p)
+
+	wantUsers := map[string]string{"tg-1": RoleMember, "tg-3": RoleAdmin}
+	if len(p.Users) != len(wantUsers) {
+		t.Errorf("users: got %v, want %v", p.Users, wantUsers)
+	}
+	for id, role := range wantUsers {
+		if p.Users[id] != role {
+			t.Errorf("user %s: got %q, want %q", id, p.Users[id], role)
+		}
+	}
+	if len(p.Chats) != 1 || p.Chats["tg--100"] != RoleMember {
+		t.Errorf("chats: got %v, want tg--100 as member only", p.Chats)
+	}
+	if _, exists := p.Defaults[anyNamespace]; exists || p.legacyAllowAll {
+		t.Error("defaults set without allow_all")
+	}
+	if p.LegacyAllowedUserID != nil || p.LegacyAllowedChatID != nil || p.LegacyAdminUserID != nil {
+		t.Error("legacy maps kept after the conversion")
+	}
+}
+
+func TestLegacyFalseIsNoBan(t *testing.T) {
+	// not allowed as a user, but the chat is allowed, which let the user in before
+	acl := newTestACL(t, Policy{
+		LegacyAllowedUserID: map[string]bool{"tg-1": false},
+		LegacyAllowedChatID: map[string]bool{"tg--100": true},
+	})
+
+	if !acl.HasPermission("tg-1", "tg--100", def.PermChat) {
+		t.Error("user set to false denied in an allowed chat")
+	}
+	if acl.HasPermission("tg-1", "tg-1", def.PermChat) {
+		t.Error("user set to false allowed in a private chat")
+	}
+}
+
+func TestLegacyAllowAll(t *testing.T) {
+	acl := newTestACL(t, Policy{
+		LegacyAllowedUserID: map[string]bool{"allow_all": true},
+		LegacyAdminUserID:   map[string]bool{"tg-1": true},
+	})
+	// the old files were shipped next to whitelistEnabled: true
+	acl.SetWhitelist(true)
+
+	if !acl.HasPermission("tg-2", "tg-2", def.PermChat) {
+		t.Error("allow_all of a legacy file ignored with the whitelist on")
+	}
+	if !acl.IsAdmin("tg-1") || acl.IsAdmin("tg-2") {
+		t.Error("only tg-1 should be admin")
+	}
+}
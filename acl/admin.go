@@ -0,0 +1,410 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package acl
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"chloe/def"
+	"chloe/util"
+)
+
+const (
+	TargetUser = "user"
+	TargetChat = "chat"
+
+	InviteValidity = 7 * 24 * time.Hour
+)
+
+// Change is one line of the audit log
+type Change struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// overlay is what admins changed while the bot runs. It is kept in the data dir
+// apart from the acl file, so the file stays as written with its comments.
+type overlay struct {
+	Users map[string]string `json:"users,omitempty"`
+	Chats map[string]string `json:"chats,omitempty"`
+	// an empty list clears the denies of the acl file
+	Deny map[string][]def.Permission `json:"deny,omitempty"`
+}
+
+func (o overlay) clone() overlay {
+	c := overlay{
+		Users: make(map[string]string),
+		Chats: make(map[string]string),
+		Deny:  make(map[string][]def.Permission),
+	}
+	for k, v := range o.Users {
+		c.Users[k] = v
+	}
+	for k, v := range o.Chats {
+		c.Chats[k] = v
+	}
+	for k, v := range o.Deny {
+		c.Deny[k] = append([]def.Permission{}, v...)
+	}
+	return c
+}
+
+// apply returns the file policy with the changes, they win over the file
+func (o overlay) apply(file Policy) Policy {
+	p := clonePolicy(file)
+	for id, role := range o.Users {
+		p.Users[id] = role
+	}
+	for id, role := range o.Chats {
+		p.Chats[id] = role
+	}
+	for id, perms := range o.Deny {
+		if len(perms) == 0 {
+			delete(p.Deny, id)
+		} else {
+			p.Deny[id] = append([]def.Permission(nil), perms...)
+		}
+	}
+	return p
+}
+
+type invite struct {
+	Role    string    `json:"role"`
+	Creator string    `json:"creator"`
+	Expires time.Time `json:"expires"`
+}
+
+// SetDataDir enables the audit log and invite codes and loads the changes kept in dir
+func (acl *AccessControl) SetDataDir(dir string) {
+	acl.guard.Lock()
+	defer acl.guard.Unlock()
+
+	acl.dataDir = dir
+
+	var changes overlay
+	if err := util.LoadJSON(acl.changesPath(), &changes); err != nil {
+		slog.Error("failed to load acl changes", "path", acl.changesPath(), "err", err)
+		return
+	}
+	policy := changes.apply(acl.file)
+	if err := policy.Validate(); err != nil {
+		slog.Error("acl changes don't fit the acl file, ignored", "path", acl.changesPath(), "err", err)
+		return
+	}
+	acl.changes, acl.policy = changes, policy
+}
+
+// Policy returns a copy of the current policy
+func (acl *AccessControl) Policy() Policy {
+	acl.guard.RLock()
+	defer acl.guard.RUnlock()
+
+	return clonePolicy(acl.policy)
+}
+
+func (acl *AccessControl) SetRole(actor def.UserID, target, id, role string) error {
+	return acl.update(actor, "set "+target+" role", id, role, setRole(target, id, role))
+}
+
+func setRole(target, id, role string) func(*overlay, Policy) {
+	return func(o *overlay, _ Policy) {
+		if target == TargetChat {
+			o.Chats[id] = role
+		} else {
+			o.Users[id] = role
+		}
+	}
+}
+
+func (acl *AccessControl) Deny(actor def.UserID, id string, perms []def.Permission) error {
+	detail := fmt.Sprint(perms)
+	return acl.update(actor, "deny", id, detail, func(o *overlay, current Policy) {
+		denied := append([]def.Permission(nil), current.Deny[id]...)
+		for _, perm := range perms {
+			if !matches(denied, perm) {
+				denied = append(denied, perm)
+			}
+		}
+		o.Deny[id] = denied
+	})
+}
+
+func (acl *AccessControl) ClearDeny(actor def.UserID, id string) error {
+	return acl.update(actor, "clear deny", id, "", func(o *overlay, _ Policy) {
+		if _, inFile := acl.file.Deny[id]; inFile {
+			o.Deny[id] = []def.Permission{}
+		} else {
+			delete(o.Deny, id)
+		}
+	})
+}
+
+// CreateInvite makes a one time code that gives the role to whoever uses it
+func (acl *AccessControl) CreateInvite(actor def.UserID, role string) (string, error) {
+	acl.guard.Lock()
+	defer acl.guard.Unlock()
+
+	if acl.dataDir == "" {
+		return "", errors.New("invites are not enabled")
+	}
+	if _, exists := acl.policy.Roles[role]; !exists {
+		if _, exists := builtinRoles[role]; !exists {
+			return "", fmt.Errorf("unknown role '%s'", role)
+		}
+	}
+
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := base32.StdEncoding.EncodeToString(buf)
+
+	invites := acl.loadInvites()
+	invites[code] = invite{
+		Role:    role,
+		Creator: actor.String(),
+		Expires: time.Now().Add(InviteValidity),
+	}
+	if err := util.SaveJSON(acl.invitesPath(), invites); err != nil {
+		return "", err
+	}
+	acl.audit(Change{Actor: actor.String(), Action: "create invite", Target: role})
+	return code, nil
+}
+
+// UseInvite gives the user the role of the invite, the code is used up only
+// once the role is given. Banned users can't use invites.
+func (acl *AccessControl) UseInvite(code string, uid def.UserID) (string, error) {
+	acl.guard.Lock()
+	defer acl.guard.Unlock()
+
+	if acl.dataDir == "" {
+		return "", errors.New("invites are not enabled")
+	}
+	invites := acl.loadInvites()
+	inv, exists := invites[code]
+	if !exists || time.Now().After(inv.Expires) {
+		return "", errors.New("the invite code is invalid or expired")
+	}
+	if acl.userRole(uid.String()) == RoleBanned {
+		return "", errors.New("banned users can't use invites")
+	}
+
+	actor := def.UserID("invite:" + inv.Creator)
+	id := uid.String()
+	if err := acl.updateLocked(actor, "set "+TargetUser+" role", id, inv.Role, setRole(TargetUser, id, inv.Role)); err != nil {
+		return "", err
+	}
+
+	delete(invites, code)
+	for c, i := range invites {
+		if time.Now().After(i.Expires) {
+			delete(invites, c)
+		}
+	}
+	if err := util.SaveJSON(acl.invitesPath(), invites); err != nil {
+		slog.Error("failed to save invites", "err", err)
+	}
+	return inv.Role, nil
+}
+
+// update changes a copy of the changes, given the current policy, and swaps them
+// in only if the policy they make is valid and they are saved
+func (acl *AccessControl) update(actor def.UserID, action, id, detail string, change func(*overlay, Policy)) error {
+	if !validNamespace(namespaceOf(id)) {
+		return fmt.Errorf("id '%s' has no namespace like tg- or rm-", id)
+	}
+
+	acl.guard.Lock()
+	defer acl.guard.Unlock()
+
+	return acl.updateLocked(actor, action, id, detail, change)
+}
+
+// updateLocked must be called with guard held
+func (acl *AccessControl) updateLocked(actor def.UserID, action, id, detail string, change func(*overlay, Policy)) error {
+	changes := acl.changes.clone()
+	change(&changes, acl.policy)
+	policy := changes.apply(acl.file)
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if err := acl.save(changes); err != nil {
+		slog.Error("failed to save acl changes", "path", acl.changesPath(), "err", err)
+		return fmt.Errorf("failed to save acl, %v", err)
+	}
+	acl.changes, acl.policy = changes, policy
+
+	acl.audit(Change{Actor: actor.String(), Action: action, Target: id, Detail: detail})
+	slog.Info("acl changed", "actor", actor.String(), "action", action, "target", id, "detail", detail)
+	return nil
+}
+
+// save must be called with guard held
+func (acl *AccessControl) save(changes overlay) error {
+	if acl.dataDir == "" {
+		return nil
+	}
+	return util.SaveJSON(acl.changesPath(), changes)
+}
+
+func (acl *AccessControl) changesPath() string {
+	return filepath.Join(acl.dataDir, "acl_changes.json")
+}
+
+// audit must be called with guard held
+func (acl *AccessControl) audit(change Change) {
+	if acl.dataDir == "" {
+		return
+	}
+	change.Time = time.Now()
+	line, err := json.Marshal(change)
+	if err != nil {
+		return
+	}
+
+	auditPath := filepath.Join(acl.dataDir, "acl_audit.jsonl")
+	f, err := os.OpenFile(auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		slog.Error("failed to open acl audit log", "path", auditPath, "err", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write acl audit log", "path", auditPath, "err", err)
+	}
+}
+
+func (acl *AccessControl) invitesPath() string {
+	return filepath.Join(acl.dataDir, "invites.json")
+}
+
+// loadInvites must be called with guard held
+func (acl *AccessControl) loadInvites() map[string]invite {
+	invites := make(map[string]invite)
+	if err := util.LoadJSON(acl.invitesPath(), &invites); err != nil {
+		slog.Error("failed to load invites", "err", err)
+	}
+	return invites
+}
+
+// Describe lists the role, denied permissions and group of the id
+func (acl *AccessControl) Describe(id string) string {
+	acl.guard.RLock()
+	defer acl.guard.RUnlock()
+
+	desc := id
+	for _, r := range []struct {
+		target      string
+		role        string
+		assignments map[string]string
+	}{
+		{TargetUser, acl.userRole(id), acl.policy.Users},
+		{TargetChat, acl.chatRole(id), acl.policy.Chats},
+	} {
+		role := r.role
+		if role == "" {
+			role = "none"
+		}
+		desc += fmt.Sprintf("\nrole as %s: %s", r.target, role)
+		if _, assigned := r.assignments[id]; !assigned {
+			desc += " (default)"
+		}
+	}
+	if perms := acl.policy.Deny[id]; len(perms) > 0 {
+		desc += fmt.Sprintf("\ndenied: %v", perms)
+	}
+	for name, members := range acl.policy.Groups {
+		for _, member := range members {
+			if member == id {
+				desc += "\ngroup: " + name
+			}
+		}
+	}
+	return desc
+}
+
+// List prints the defaults, assignments and denies
+func (acl *AccessControl) List() string {
+	acl.guard.RLock()
+	defer acl.guard.RUnlock()
+
+	out := "defaults:\n" + formatAssignments(acl.policy.Defaults)
+	out += "users:\n" + formatAssignments(acl.policy.Users)
+	out += "chats:\n" + formatAssignments(acl.policy.Chats)
+	if len(acl.policy.Deny) > 0 {
+		out += "deny:\n"
+		var ids []string
+		for id := range acl.policy.Deny {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			out += fmt.Sprintf("  %s: %v\n", id, acl.policy.Deny[id])
+		}
+	}
+	return out
+}
+
+func formatAssignments(assignments map[string]string) string {
+	var ids []string
+	for id := range assignments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	out := ""
+	for _, id := range ids {
+		out += fmt.Sprintf("  %s: %s\n", id, assignments[id])
+	}
+	return out
+}
+
+func clonePolicy(p Policy) Policy {
+	c := Policy{
+		Roles:    make(map[string]RoleDef),
+		Defaults: make(map[string]string),
+		Users:    make(map[string]string),
+		Chats:    make(map[string]string),
+		Deny:     make(map[string][]def.Permission),
+		Groups:   make(map[string][]string),
+
+		legacyAllowAll: p.legacyAllowAll,
+	}
+	for k, v := range p.Roles {
+		c.Roles[k] = RoleDef{
+			Allow: append([]def.Permission(nil), v.Allow...),
+			Deny:  append([]def.Permission(nil), v.Deny...),
+		}
+	}
+	for k, v := range p.Defaults {
+		c.Defaults[k] = v
+	}
+	for k, v := range p.Users {
+		c.Users[k] = v
+	}
+	for k, v := range p.Chats {
+		c.Chats[k] = v
+	}
+	for k, v := range p.Deny {
+		c.Deny[k] = append([]def.Permission(nil), v...)
+	}
+	for k, v := range p.Groups {
+		c.Groups[k] = append([]string(nil), v...)
+	}
+	return c
+}
@@ -6,13 +6,21 @@ package ai
 
 import (
 	"chloe/def"
+	"chloe/logging"
+	"chloe/metrics"
+	"chloe/tracing"
 	"context"
 	"time"
 
-	log "github.com/jeanphorn/log4go"
 	"github.com/sashabaranov/go-openai"
 )
 
+const (
+	SpeechModel = openai.Whisper1
+	// the largest file whisper takes
+	SpeechMaxBytes = 25 << 20
+)
+
 type whisper struct {
 	client *openai.Client
 }
@@ -24,18 +32,23 @@ func NewSpeech2Text(apiKey string) def.SpeechToText {
 	}
 }
 
-func (w *whisper) Convert(voiceFile string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*45)
+func (w *whisper) Convert(ctx context.Context, voiceFile string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*45)
 	defer cancel()
+	ctx, span := tracing.Start(ctx, "openai transcription", tracing.KeyModel.String(SpeechModel))
+	var err error
+	defer func() { tracing.End(span, err) }()
 
 	req := openai.AudioRequest{
-		Model:    openai.Whisper1,
+		Model:    SpeechModel,
 		FilePath: voiceFile,
 	}
 
+	start := time.Now()
 	resp, err := w.client.CreateTranscription(ctx, req)
+	metrics.ObserveAI(metrics.BackendSpeechToText, start, err)
 	if err != nil {
-		log.Error("failed to get speech transcripted, %v", err)
+		logging.FromContext(ctx).Error("speech to text failed", "file", voiceFile, "err", err)
 		return "", err
 	}
 
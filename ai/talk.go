@@ -6,24 +6,36 @@ package ai
 
 import (
 	"fmt"
+	"log/slog"
+	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"chloe/def"
+	"chloe/logging"
+	"chloe/metrics"
+	"chloe/tracing"
 	"context"
 
-	log "github.com/jeanphorn/log4go"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	MaxMessageQueueToken = 3000
 	ContextAwareTime     = time.Minute
 	CompletionTimeout    = 100 * time.Second
+
+	backgroundPrompt = "Meanwhile in the group, not said to you:"
+	apologyText      = "I apologize, but the OpenAI API is currently experiencing high traffic. Kindly try again at a later time."
 )
 
+// names openai takes in the name field, others go before the question
+var speakerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
 // / singleton client
 var lock = &sync.Mutex{}
 var clients = make(map[string]*openai.Client)
@@ -47,15 +59,42 @@ type AIConfig struct {
 	ApiKey         string
 	Model          string
 	ContextTimeout int
+	Models         []string
+	// Persona is the system prompt, a generic assistant if empty
+	Persona string
 }
 
 type qa struct {
 	q string
 	a string
 	s string
+	// name of who asked q, empty if it is the only user
+	name string
+}
+
+// tokens counts the tokens of all the parts, roughly
+func (m qa) tokens() int {
+	return getTokenCount(m.q) + getTokenCount(m.a) + getTokenCount(m.s) + getTokenCount(m.name)
+}
+
+func (m qa) question() openai.ChatCompletionMessage {
+	msg := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: m.q,
+	}
+	if speakerNamePattern.MatchString(m.name) {
+		msg.Name = m.name
+	} else if m.name != "" {
+		msg.Content = m.name + ": " + m.q
+	}
+	return msg
 }
 
 type OpenAITalk struct {
+	// one question at a time, so each one has the answers before it as history
+	turn sync.Mutex
+	// guards the settings below against config reloads, and the history
+	guard        sync.Mutex
 	id           def.ConversationId
 	bot          string
 	greeting     qa
@@ -75,10 +114,7 @@ func NewTalk(cfg AIConfig) def.Conversation {
 		id:  def.ConversationId(atomic.AddInt64(&talkId, 1)),
 		bot: cfg.BotName,
 		greeting: qa{
-			s: fmt.Sprintf(
-				"You are a helpful assistant. Your name is %s.",
-				cfg.BotName,
-			),
+			s: greetingOf(cfg),
 		},
 		model:        cfg.Model,
 		client:       getOpenAIClient(cfg.ApiKey),
@@ -92,9 +128,76 @@ func (conv *OpenAITalk) GetID() def.ConversationId {
 	return conv.id
 }
 
-func (conv *OpenAITalk) Ask(q string) string {
-	conv.PrepareNewMessage(q)
+func greetingOf(cfg AIConfig) string {
+	if cfg.Persona != "" {
+		return cfg.Persona
+	}
+	return fmt.Sprintf("You are a helpful assistant. Your name is %s.", cfg.BotName)
+}
+
+func (conv *OpenAITalk) GetModel() string {
+	conv.guard.Lock()
+	defer conv.guard.Unlock()
+
+	return conv.model
+}
+
+func (conv *OpenAITalk) SetModel(model string) {
+	conv.guard.Lock()
+	defer conv.guard.Unlock()
+
+	conv.model = model
+}
+
+// reconfigure applies reloaded settings, the model a user switched to stays while it is offered
+func (conv *OpenAITalk) reconfigure(cfg AIConfig, oldModel string) {
+	conv.guard.Lock()
+	defer conv.guard.Unlock()
 
+	conv.bot = cfg.BotName
+	conv.greeting = qa{s: greetingOf(cfg)}
+	conv.client = getOpenAIClient(cfg.ApiKey)
+	conv.contextAware = time.Duration(cfg.ContextTimeout) * time.Second
+
+	offered := conv.model == cfg.Model
+	for _, m := range cfg.Models {
+		offered = offered || m == conv.model
+	}
+	if conv.model == oldModel || !offered {
+		conv.model = cfg.Model
+	}
+}
+
+func (conv *OpenAITalk) Ask(ctx context.Context, q string) (string, def.Usage) {
+	conv.turn.Lock()
+	defer conv.turn.Unlock()
+
+	return conv.ask(ctx, qa{q: q})
+}
+
+// AskAs asks with the name of the speaker, what the group said meanwhile
+// goes before the question as a system message
+func (conv *OpenAITalk) AskAs(ctx context.Context, speaker, q string, background []def.Remark) (string, def.Usage) {
+	next := qa{q: q, name: speaker}
+	if len(background) > 0 {
+		lines := []string{backgroundPrompt}
+		for _, r := range background {
+			lines = append(lines, r.Speaker+": "+r.Text)
+		}
+		next.s = strings.Join(lines, "\n")
+	}
+
+	conv.turn.Lock()
+	defer conv.turn.Unlock()
+
+	return conv.ask(ctx, next)
+}
+
+// ask must be called with turn held
+func (conv *OpenAITalk) ask(ctx context.Context, next qa) (string, def.Usage) {
+	conv.guard.Lock()
+	conv.prepareNewMessage(next)
+	client, model := conv.client, conv.model
 	var messages []openai.ChatCompletionMessage
 	for _, msg := range conv.messageQueue {
 		if msg.s != "" {
@@ -106,12 +209,7 @@ func (conv *OpenAITalk) Ask(q string) string {
 			)
 		}
 		if msg.q != "" {
-			messages = append(messages,
-				openai.ChatCompletionMessage{
-					Role:    openai.ChatMessageRoleUser,
-					Content: msg.q,
-				},
-			)
+			messages = append(messages, msg.question())
 		}
 		if msg.a != "" {
 			messages = append(messages,
@@ -122,25 +220,49 @@ func (conv *OpenAITalk) Ask(q string) string {
 			)
 		}
 	}
+	conv.guard.Unlock()
+
+	answer, usage, err := complete(ctx, client, model, messages)
+
+	conv.guard.Lock()
+	defer conv.guard.Unlock()
+
+	conv.lastMessage = time.Now()
+	if err != nil {
+		return apologyText, usage
+	}
+	if answer != "" {
+		conv.messageQueue[len(conv.messageQueue)-1].a = answer
+	}
+	return answer, usage
+}
+
+// complete asks the model to answer the messages, a few times if it fails
+func complete(ctx context.Context, client *openai.Client, model string, messages []openai.ChatCompletionMessage) (string, def.Usage, error) {
+	logger := logging.FromContext(ctx).With("model", model)
 	var resp openai.ChatCompletionResponse
 	var err error
+	ctx, span := tracing.Start(ctx, "openai chat", tracing.KeyModel.String(model))
+	defer func() { tracing.End(span, err) }()
 	retry := 3
-	for retry > 0 {
+	for retry > 0 && ctx.Err() == nil {
 		if func() bool {
-			ctx, cancel := context.WithTimeout(context.Background(), CompletionTimeout)
+			callCtx, cancel := context.WithTimeout(ctx, CompletionTimeout)
 			defer cancel()
-			resp, err = conv.client.CreateChatCompletion(
-				ctx,
+			start := time.Now()
+			defer func() { metrics.ObserveAI(metrics.BackendChat, start, err) }()
+			resp, err = client.CreateChatCompletion(
+				callCtx,
 				openai.ChatCompletionRequest{
-					Model:       conv.model,
+					Model:       model,
 					Messages:    messages,
 					Temperature: 0.9,
 				},
 			)
-			conv.lastMessage = time.Now()
 
 			if err != nil {
-				log.Info("ChatCompletion error: %v\n", err)
+				logger.Warn("chat completion failed", "retries", retry-1, "err", err)
+				span.AddEvent("chat completion failed", trace.WithAttributes(attribute.String("error", err.Error())))
 				return false
 			}
 
@@ -150,28 +272,58 @@ func (conv *OpenAITalk) Ask(q string) string {
 		}
 		retry--
 	}
+	if err == nil && len(resp.Choices) == 0 {
+		// canceled before the first try, or openai answered nothing
+		err = fmt.Errorf("no answer, %v", ctx.Err())
+	}
 
 	if err != nil {
-		log.Info("failed to get response from openai.")
-		return "I apologize, but the OpenAI API is currently experiencing high traffic. Kindly try again at a later time."
+		logger.Error("no answer from openai", "err", err)
+		return "", def.Usage{Model: model}, err
 	}
 
-	answer := resp.Choices[0].Message.Content
-	if answer != "" {
-		conv.messageQueue[len(conv.messageQueue)-1].a = answer
+	usage := def.Usage{
+		Model:            model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}
+	logger.Debug("answer received",
+		slog.Int("promptTokens", usage.PromptTokens),
+		slog.Int("completionTokens", usage.CompletionTokens),
+	)
+	span.SetAttributes(
+		attribute.Int("chloe.tokens.prompt", usage.PromptTokens),
+		attribute.Int("chloe.tokens.completion", usage.CompletionTokens),
+	)
+	return resp.Choices[0].Message.Content, usage, nil
+}
+
+// Regenerate asks q again for the same speaker with the same background
+func (conv *OpenAITalk) Regenerate(ctx context.Context, q string) (string, def.Usage) {
+	conv.turn.Lock()
+	defer conv.turn.Unlock()
+
+	conv.guard.Lock()
+	next := qa{q: q}
+	if n := len(conv.messageQueue); n > 0 && conv.messageQueue[n-1].q == q {
+		last := conv.messageQueue[n-1]
+		next.name, next.s = last.name, last.s
+		conv.messageQueue = conv.messageQueue[:n-1]
 	}
-	return answer
+	conv.guard.Unlock()
+
+	return conv.ask(ctx, next)
 }
 
-func (conv *OpenAITalk) PrepareNewMessage(msg string) {
-	totalTtoken := getTokenCount(msg) + getTokenCount(conv.greeting.s)
-	newQueue := []qa{{q: msg}}
+func (conv *OpenAITalk) prepareNewMessage(next qa) {
+	totalTtoken := next.tokens() + getTokenCount(conv.greeting.s)
+	newQueue := []qa{next}
 
 	now := time.Now()
 	old := now.After(conv.lastMessage.Add(conv.contextAware))
 
 	for i := len(conv.messageQueue) - 1; i > 0 && totalTtoken < MaxMessageQueueToken && !old; i-- {
-		cnt := getTokenCount(conv.messageQueue[i].q) + getTokenCount(conv.messageQueue[i].a)
+		cnt := conv.messageQueue[i].tokens()
 		if totalTtoken+cnt > MaxMessageQueueToken {
 			break
 		}
@@ -195,6 +347,7 @@ func getTokenCount(msg string) int {
 }
 
 type TalkFactory struct {
+	guard  sync.Mutex
 	talks  map[def.ChatID]def.Conversation
 	config AIConfig
 }
@@ -207,6 +360,9 @@ func NewTalkFactory(config AIConfig) def.ConversationFactory {
 }
 
 func (tf *TalkFactory) GetTalk(chatId def.ChatID) def.Conversation {
+	tf.guard.Lock()
+	defer tf.guard.Unlock()
+
 	talk, exists := tf.talks[chatId]
 	if !exists {
 		talk = NewTalk(tf.config)
@@ -215,3 +371,51 @@ func (tf *TalkFactory) GetTalk(chatId def.ChatID) def.Conversation {
 
 	return talk
 }
+
+// Complete answers a single prompt with the default model, apart from any talk
+func (tf *TalkFactory) Complete(ctx context.Context, system, prompt string) (string, def.Usage) {
+	tf.guard.Lock()
+	client, model := getOpenAIClient(tf.config.ApiKey), tf.config.Model
+	tf.guard.Unlock()
+
+	var messages []openai.ChatCompletionMessage
+	if system != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: system,
+		})
+	}
+	messages = append(messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: prompt,
+	})
+	answer, usage, err := complete(ctx, client, model, messages)
+	if err != nil {
+		return apologyText, usage
+	}
+	return answer, usage
+}
+
+// CheckHealth lists the models, which fails if openai can't be reached or refuses the api key
+func (tf *TalkFactory) CheckHealth(ctx context.Context) error {
+	tf.guard.Lock()
+	client := getOpenAIClient(tf.config.ApiKey)
+	tf.guard.Unlock()
+
+	_, err := client.ListModels(ctx)
+	return err
+}
+
+// Reconfigure applies new settings to new and running talks
+func (tf *TalkFactory) Reconfigure(config AIConfig) {
+	tf.guard.Lock()
+	defer tf.guard.Unlock()
+
+	oldModel := tf.config.Model
+	tf.config = config
+	for _, talk := range tf.talks {
+		if t, ok := talk.(*OpenAITalk); ok {
+			t.reconfigure(config, oldModel)
+		}
+	}
+}
@@ -7,18 +7,22 @@ package ai
 import (
 	"bytes"
 	"chloe/def"
+	"chloe/logging"
+	"chloe/metrics"
+	"chloe/tracing"
 	"context"
 	"encoding/base64"
 	"image/png"
 	"os"
 	"time"
 
-	log "github.com/jeanphorn/log4go"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
 	ImageGenerateTimeout = 120 * time.Second
+	ImageModel           = "dall-e-2"
 )
 
 // / image generate
@@ -33,54 +37,65 @@ func NewImageGenerator(apiKey string) def.ImageGenerator {
 	}
 }
 
-func (d *dalle) Generate(desc, size string) (string, def.CleanFunc, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), ImageGenerateTimeout)
-	defer cancel()
-	var imgSize string
+// ImageSize turns the size code s, m or b into the size in pixels
+func ImageSize(size string) string {
 	switch size {
 	case "m":
-		imgSize = openai.CreateImageSize512x512
+		return openai.CreateImageSize512x512
 	case "s":
-		imgSize = openai.CreateImageSize256x256
+		return openai.CreateImageSize256x256
 	case "b":
-		imgSize = openai.CreateImageSize1024x1024
+		return openai.CreateImageSize1024x1024
+	default:
+		return ""
 	}
+}
+
+func (d *dalle) Generate(ctx context.Context, desc, size string) (string, def.CleanFunc, error) {
+	ctx, cancel := context.WithTimeout(ctx, ImageGenerateTimeout)
+	defer cancel()
+	logger := logging.FromContext(ctx)
+	ctx, span := tracing.Start(ctx, "openai image", tracing.KeyModel.String(ImageModel), attribute.String("chloe.size", size))
+	var err error
+	defer func() { tracing.End(span, err) }()
 	reqBase64 := openai.ImageRequest{
 		Prompt:         desc,
-		Size:           imgSize,
+		Size:           ImageSize(size),
 		ResponseFormat: openai.CreateImageResponseFormatB64JSON,
 		N:              1,
 	}
 
+	start := time.Now()
 	respBase64, err := d.client.CreateImage(ctx, reqBase64)
+	metrics.ObserveAI(metrics.BackendImage, start, err)
 	if err != nil {
-		log.Error(`image creation error on description " %s", %v`, desc, err)
+		logger.Error("image creation failed", logging.Text("description", desc), "err", err)
 		return "", nil, err
 	}
 
 	imgBytes, err := base64.StdEncoding.DecodeString(respBase64.Data[0].B64JSON)
 	if err != nil {
-		log.Error("base64 decode error: %v", err)
+		logger.Error("image base64 decode failed", "err", err)
 		return "", nil, err
 	}
 
 	r := bytes.NewReader(imgBytes)
 	imgData, err := png.Decode(r)
 	if err != nil {
-		log.Error("PNG decode error: %v", err)
+		logger.Error("image png decode failed", "err", err)
 		return "", nil, err
 	}
 
 	f, err := os.CreateTemp("", "*.png")
 	if err != nil {
-		log.Error("File creation error: %v", err)
+		logger.Error("image file creation failed", "err", err)
 		return "", nil, err
 	}
 	defer f.Close()
 	fname := f.Name()
 
-	if err := png.Encode(f, imgData); err != nil {
-		log.Error("PNG encode error: %v", err)
+	if err = png.Encode(f, imgData); err != nil {
+		logger.Error("image png encode failed", "err", err)
 		return "", nil, err
 	}
 
@@ -88,3 +103,26 @@ func (d *dalle) Generate(desc, size string) (string, def.CleanFunc, error) {
 		_ = os.Remove(fname)
 	}, nil
 }
+
+// GenerateURL leaves the image with openai, the link is valid for an hour
+func (d *dalle) GenerateURL(ctx context.Context, desc, size string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ImageGenerateTimeout)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "openai image", tracing.KeyModel.String(ImageModel), attribute.String("chloe.size", size))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	resp, err := d.client.CreateImage(ctx, openai.ImageRequest{
+		Prompt:         desc,
+		Size:           ImageSize(size),
+		ResponseFormat: openai.CreateImageResponseFormatURL,
+		N:              1,
+	})
+	metrics.ObserveAI(metrics.BackendImage, start, err)
+	if err != nil {
+		logging.FromContext(ctx).Error("image creation failed", logging.Text("description", desc), "err", err)
+		return "", err
+	}
+	return resp.Data[0].URL, nil
+}
@@ -6,8 +6,13 @@ package ai
 
 import (
 	"chloe/def"
+	"chloe/logging"
+	"chloe/metrics"
+	"chloe/tracing"
 	"context"
+	"fmt"
 	//"io/ioutil"
+	"log/slog"
 	"os"
 	"time"
 
@@ -15,8 +20,9 @@ import (
 
 	//htgotts "github.com/hegedustibor/htgo-tts"
 	//"github.com/hegedustibor/htgo-tts/voices"
-	log "github.com/jeanphorn/log4go"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
@@ -52,6 +58,7 @@ func (tts *googleTransTTS) Convert(text string) (string, def.CleanFunc, error) {
 */
 
 type pyServiceTTS struct {
+	conn   *grpc.ClientConn
 	client pys.GoogleTranslateTTSClient
 }
 
@@ -61,37 +68,65 @@ func NewPyServiceTTS() def.TextToSpeech {
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 	)
 	if err != nil {
-		log.Error("can not dial to external grpc service, %v", err)
+		slog.Error("can not dial to the python tts service", "err", err)
 		return nil
 	}
 	return &pyServiceTTS{
+		conn:   conn,
 		client: pys.NewGoogleTranslateTTSClient(conn),
 	}
 }
 
-func (tts *pyServiceTTS) Convert(text string) (string, def.CleanFunc, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+func (tts *pyServiceTTS) Close() error {
+	return tts.conn.Close()
+}
+
+// CheckHealth fails while the python service can't be connected
+func (tts *pyServiceTTS) CheckHealth(ctx context.Context) error {
+	tts.conn.Connect()
+	for {
+		state := tts.conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return fmt.Errorf("python service is %s", state)
+		}
+		if !tts.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("python service is %s, %v", state, ctx.Err())
+		}
+	}
+}
+
+func (tts *pyServiceTTS) Convert(ctx context.Context, text string) (string, def.CleanFunc, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*60)
 	defer cancel()
+	logger := logging.FromContext(ctx)
+	ctx, span := tracing.Start(ctx, "tts convert", attribute.Int("chloe.length", len(text)))
+	var err error
+	defer func() { tracing.End(span, err) }()
 
+	start := time.Now()
 	resp, err := tts.client.TextToSpeech(ctx, &pys.Text{
 		Text: text,
 	})
+	metrics.ObserveAI(metrics.BackendTextToSpeech, start, err)
 	if err != nil {
-		log.Error("grpc call failed, %v", err)
+		logger.Error("text to speech failed", "err", err)
 		return "", nil, err
 	}
 
 	f, err := os.CreateTemp("", "*.mp3")
 	if err != nil {
-		log.Error("file creation error: %v", err)
+		logger.Error("speech file creation failed", "err", err)
 		return "", nil, err
 	}
 	defer f.Close()
 	fname := f.Name()
 
 	speech := resp.FileResponse.Data
-	if _, err := f.Write(speech); err != nil {
-		log.Error("save mp3 failed, %v", err)
+	if _, err = f.Write(speech); err != nil {
+		logger.Error("speech file write failed", "err", err)
 		return "", nil, err
 	}
 
@@ -0,0 +1,160 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"chloe/acl"
+	"chloe/def"
+	"chloe/logging"
+	"chloe/pipeline"
+)
+
+const (
+	callbackAccess = "access"
+
+	accessRequest = "request"
+	accessApprove = "approve"
+	accessDeny    = "deny"
+
+	// a user can ask for access again after this long
+	accessRequestCooldown = time.Hour
+)
+
+// requestTracker remembers when a key last asked for something
+type requestTracker struct {
+	guard    sync.Mutex
+	cooldown time.Duration
+	last     map[string]time.Time
+}
+
+func newRequestTracker(cooldown time.Duration) *requestTracker {
+	return &requestTracker{
+		cooldown: cooldown,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// allow records the request and tells if the previous one is long enough ago
+func (t *requestTracker) allow(key string) bool {
+	t.guard.Lock()
+	defer t.guard.Unlock()
+
+	now := time.Now()
+	for k, last := range t.last {
+		if now.Sub(last) >= t.cooldown {
+			delete(t.last, k)
+		}
+	}
+	if _, exists := t.last[key]; exists {
+		return false
+	}
+	t.last[key] = now
+	return true
+}
+
+func (t *requestTracker) forget(key string) {
+	t.guard.Lock()
+	defer t.guard.Unlock()
+
+	delete(t.last, key)
+}
+
+// rejectAccess turns a sender without access away, with a button to ask the admins
+// unless the sender is banned
+func (s *BotTalkService) rejectAccess(ctx *pipeline.Context) {
+	bc, ok := ctx.Chat.(def.ButtonChat)
+	if !ok || s.accessControl.UserRole(ctx.User.GetID()) == acl.RoleBanned || len(s.accessControl.Admins()) == 0 {
+		ctx.Reply(notAllowedText)
+		return
+	}
+	bc.ReplyButtons(notAllowedText, ctx.Message.GetID(), [][]def.Button{{
+		{Text: "Request access", Data: callbackAccess + ":" + accessRequest},
+	}})
+}
+
+func (s *BotTalkService) accessCallback(cb def.Callback, payload string) {
+	action, id, _ := strings.Cut(payload, ":")
+	switch action {
+	case accessRequest:
+		s.requestAccess(cb)
+	case accessApprove, accessDeny:
+		s.decideAccess(cb, action, id)
+	default:
+		cb.Answer("")
+	}
+}
+
+func (s *BotTalkService) requestAccess(cb def.Callback) {
+	user := cb.GetUser()
+	uid := user.GetID()
+	if s.accessControl.UserRole(uid) == acl.RoleBanned {
+		cb.Answer("Sorry, your access has been declined.")
+		return
+	}
+	if !s.accessRequests.allow(uid.String()) {
+		cb.Answer("Your request is already sent, please wait for the administrators.")
+		return
+	}
+
+	text := fmt.Sprintf("%s (@%s, %s) requests access.", user.GetFirstName(), user.GetUserName(), uid.String())
+	fallback := text + fmt.Sprintf("\nSend /allow %s to approve or /ban %s to decline.", uid.String(), uid.String())
+	buttons := [][]def.Button{{
+		{Text: "Approve", Data: callbackAccess + ":" + accessApprove + ":" + uid.String()},
+		{Text: "Deny", Data: callbackAccess + ":" + accessDeny + ":" + uid.String()},
+	}}
+	sent := 0
+	for _, admin := range s.accessControl.Admins() {
+		// the private chat with a user has the user's id
+		if err := s.sendButtons(def.ChatID(admin), text, fallback, buttons); err != nil {
+			slog.Warn("failed to send access request to admin", "admin", admin.String(), "err", err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		s.accessRequests.forget(uid.String())
+		cb.Answer("Sorry, no administrator can be reached right now.")
+		return
+	}
+
+	slog.Info("access requested", logging.KeyUser, uid.String())
+	cb.Answer("Your request has been sent to the administrators.")
+	editMessage(cb.GetChat(), cb.GetMessageID(), notAllowedText+"\n\nAccess requested, you will be told once it is decided.")
+}
+
+func (s *BotTalkService) decideAccess(cb def.Callback, action, id string) {
+	admin := cb.GetUser()
+	if !s.accessControl.IsAdmin(admin.GetID()) {
+		cb.Answer("Only administrators can decide access requests.")
+		return
+	}
+	// another admin may have been faster
+	if role, assigned := s.accessControl.Policy().Users[id]; assigned {
+		cb.Answer("Already decided.")
+		editMessage(cb.GetChat(), cb.GetMessageID(), fmt.Sprintf("%s is %s.", id, role))
+		return
+	}
+
+	role, result, notice := acl.RoleMember, "approved", "Your access request was approved, welcome!"
+	if action == accessDeny {
+		role, result, notice = acl.RoleBanned, "declined", "Sorry, your access request was declined."
+	}
+	if err := s.accessControl.SetRole(admin.GetID(), acl.TargetUser, id, role); err != nil {
+		cb.Answer(err.Error())
+		return
+	}
+
+	cb.Answer(fmt.Sprintf("%s is %s now.", id, role))
+	editMessage(cb.GetChat(), cb.GetMessageID(), fmt.Sprintf("Access of %s %s by @%s.", id, result, admin.GetUserName()))
+	if err := s.SendMessage(def.ChatID(id), notice); err != nil {
+		slog.Warn("failed to tell the user the access decision", logging.KeyUser, id, "err", err)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"fmt"
+	"strings"
+
+	"chloe/acl"
+	"chloe/command"
+	"chloe/def"
+	"chloe/logging"
+)
+
+func (s *BotTalkService) aclCommands() []*command.Command {
+	return []*command.Command{
+		{
+			Name:       "allow",
+			Args:       "[user|chat] <id|here> [role]",
+			Help:       "give a user or chat a role, member by default",
+			Permission: def.PermAdmin,
+			MinArgs:    1,
+			Handler:    s.allowCommand,
+		},
+		{
+			Name:       "deny",
+			Args:       "<id|here> <permission...|clear>",
+			Help:       "take permissions from a user or chat",
+			Permission: def.PermAdmin,
+			MinArgs:    2,
+			Handler:    s.denyCommand,
+		},
+		{
+			Name:       "ban",
+			Args:       "[user|chat] <id|here>",
+			Help:       "ban a user or chat",
+			Permission: def.PermAdmin,
+			MinArgs:    1,
+			Handler:    s.banCommand,
+		},
+		{
+			Name:       "whois",
+			Args:       "[id|here]",
+			Help:       "show the role and permissions of a user or chat",
+			Permission: def.PermAdmin,
+			Handler:    s.whoisCommand,
+		},
+		{
+			Name:       "acl",
+			Args:       "list",
+			Help:       "list the access control",
+			Permission: def.PermAdmin,
+			MinArgs:    1,
+			Handler:    s.aclCommand,
+		},
+		{
+			Name:       "invite",
+			Args:       "[role]",
+			Help:       "create a one time invite code, member by default",
+			Permission: def.PermAdmin,
+			Handler:    s.inviteCommand,
+		},
+		{
+			Name:    "start",
+			Args:    "[invite code]",
+			Help:    "start talking, with an invite code to get access",
+			Hidden:  true,
+			Handler: s.startCommand,
+		},
+	}
+}
+
+// aclTarget reads the optional user/chat keyword and the id from the arguments,
+// "here" is the current chat. Telegram group ids are negative, so tg-- ids are chats.
+func aclTarget(ctx *command.Context) (string, string, []string) {
+	args := ctx.Args
+	target := ""
+	if len(args) > 0 && (args[0] == acl.TargetUser || args[0] == acl.TargetChat) {
+		target, args = args[0], args[1:]
+	}
+	if len(args) == 0 {
+		return "", "", nil
+	}
+
+	id := args[0]
+	if id == "here" {
+		id = ctx.Chat.GetID().String()
+		if target == "" {
+			target = acl.TargetChat
+		}
+	}
+	if target == "" {
+		target = acl.TargetUser
+		if strings.HasPrefix(id, def.PrefixTelegram+"-") {
+			target = acl.TargetChat
+		}
+	}
+	return target, id, args[1:]
+}
+
+func (s *BotTalkService) allowCommand(ctx *command.Context) {
+	target, id, rest := aclTarget(ctx)
+	if id == "" {
+		ctx.ReplyUsage()
+		return
+	}
+	role := acl.RoleMember
+	if len(rest) > 0 {
+		role = rest[0]
+	}
+	s.setRole(ctx, target, id, role)
+}
+
+func (s *BotTalkService) banCommand(ctx *command.Context) {
+	target, id, _ := aclTarget(ctx)
+	if id == "" {
+		ctx.ReplyUsage()
+		return
+	}
+	s.setRole(ctx, target, id, acl.RoleBanned)
+}
+
+func (s *BotTalkService) setRole(ctx *command.Context, target, id, role string) {
+	if err := s.accessControl.SetRole(ctx.User.GetID(), target, id, role); err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	ctx.Reply(fmt.Sprintf("%s %s is now %s.", target, id, role))
+}
+
+func (s *BotTalkService) denyCommand(ctx *command.Context) {
+	_, id, rest := aclTarget(ctx)
+	if id == "" || len(rest) == 0 {
+		ctx.ReplyUsage()
+		return
+	}
+
+	actor := ctx.User.GetID()
+	if rest[0] == "clear" {
+		if err := s.accessControl.ClearDeny(actor, id); err != nil {
+			ctx.Reply(err.Error())
+			return
+		}
+		ctx.Reply(fmt.Sprintf("Denied permissions of %s cleared.", id))
+		return
+	}
+
+	var perms []def.Permission
+	for _, p := range rest {
+		perms = append(perms, def.Permission(p))
+	}
+	if err := s.accessControl.Deny(actor, id, perms); err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	ctx.Reply(fmt.Sprintf("%s is denied %s.", id, strings.Join(rest, ", ")))
+}
+
+func (s *BotTalkService) whoisCommand(ctx *command.Context) {
+	id := ctx.Chat.GetID().String()
+	if _, who, _ := aclTarget(ctx); who != "" {
+		id = who
+	}
+	ctx.Reply(s.accessControl.Describe(id))
+}
+
+func (s *BotTalkService) aclCommand(ctx *command.Context) {
+	switch ctx.Arg(0) {
+	case "list":
+		ctx.Reply(s.accessControl.List())
+	default:
+		ctx.ReplyUsage()
+	}
+}
+
+func (s *BotTalkService) inviteCommand(ctx *command.Context) {
+	role := acl.RoleMember
+	if ctx.Arg(0) != "" {
+		role = ctx.Arg(0)
+	}
+	code, err := s.accessControl.CreateInvite(ctx.User.GetID(), role)
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	ctx.Reply(fmt.Sprintf(
+		"Invite code for role %s: %s\nIt can be used once within %d days by sending /start %s to the bot.",
+		role,
+		code,
+		int(acl.InviteValidity.Hours()/24),
+		code,
+	))
+}
+
+func (s *BotTalkService) startCommand(ctx *command.Context) {
+	code := ctx.Arg(0)
+	// users sent over from an inline query they may not make yet
+	if code == "" || code == inlineStartParameter {
+		ctx.Reply(fmt.Sprintf("Hello, I'm %s. Ask me anything, or send /help to see what I can do.", s.aiConfig().BotName))
+		return
+	}
+
+	uid := ctx.User.GetID()
+	role, err := s.accessControl.UseInvite(strings.ToUpper(code), uid)
+	if err != nil {
+		logging.FromContext(ctx.Ctx).Info("failed to use invite code", "err", err)
+		ctx.Reply(err.Error())
+		return
+	}
+	logging.FromContext(ctx.Ctx).Info("joined by invite", "role", role)
+	ctx.Reply(fmt.Sprintf("Welcome! You have been granted the %s role. Send /help to see what you can do.", role))
+}
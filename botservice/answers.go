@@ -0,0 +1,263 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"chloe/accounting"
+	"chloe/def"
+	"chloe/logging"
+	"chloe/taskqueue"
+	"chloe/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	callbackAnswer = "answer"
+
+	answerRegenerate = "regen"
+	answerContinue   = "more"
+	answerSpeak      = "speak"
+	answerTranslate  = "tr"
+
+	// answers the buttons can act on, older ones are forgotten
+	answerStoreSize = 1000
+	answerMaxAge    = 24 * time.Hour
+
+	continuePrompt = "Please continue."
+	// language of the translation when the user's is unknown
+	defaultTranslateTo = "en"
+	translatePrompt    = "Translate the following text into the language with the code %q." +
+		" If it is already in that language, translate it into English. Reply with the translation only.\n\n%s"
+)
+
+// answer is a reply with buttons, kept so a press knows what it was about
+type answer struct {
+	question string
+	text     string
+	// the message the answer replied to
+	replyTo def.MessageID
+	// the conversation and the user that asked, the buttons act on them whoever presses
+	thread  def.ChatID
+	speaker def.User
+	created time.Time
+}
+
+// answerStore keeps the latest answers by a random id, the id goes into the button data
+type answerStore struct {
+	guard   sync.Mutex
+	answers map[string]*answer
+	// ids from the oldest to the latest
+	order []string
+}
+
+func newAnswerStore() *answerStore {
+	return &answerStore{
+		answers: make(map[string]*answer),
+	}
+}
+
+func (st *answerStore) add(a *answer) string {
+	st.guard.Lock()
+	defer st.guard.Unlock()
+
+	id := logging.NewID()
+	a.created = time.Now()
+	st.answers[id] = a
+	st.order = append(st.order, id)
+	if len(st.order) > answerStoreSize {
+		delete(st.answers, st.order[0])
+		st.order = st.order[1:]
+	}
+	return id
+}
+
+// get returns the answer of the id, nil if it is forgotten or too old
+func (st *answerStore) get(id string) *answer {
+	st.guard.Lock()
+	defer st.guard.Unlock()
+
+	a, exists := st.answers[id]
+	if !exists || time.Since(a.created) > answerMaxAge {
+		return nil
+	}
+	return a
+}
+
+// replyAnswer replies with buttons to regenerate, continue, read aloud or translate
+// the answer, chats without buttons get the plain answer
+func (s *BotTalkService) replyAnswer(chat def.Chat, to def.MessageID, thread def.ChatID, speaker def.User, question, text string) {
+	bc, ok := chat.(def.ButtonChat)
+	if !ok {
+		chat.ReplyMessage(text, to)
+		return
+	}
+
+	id := s.answers.add(&answer{
+		question: question,
+		text:     text,
+		replyTo:  to,
+		thread:   thread,
+		speaker:  speaker,
+	})
+	data := func(action string) string {
+		return callbackAnswer + ":" + action + ":" + id
+	}
+	second := []def.Button{{Text: "Translate", Data: data(answerTranslate)}}
+	if s.textToSpeech != nil {
+		second = append([]def.Button{{Text: "Read aloud", Data: data(answerSpeak)}}, second...)
+	}
+	bc.ReplyButtons(text, to, [][]def.Button{
+		{
+			{Text: "Regenerate", Data: data(answerRegenerate)},
+			{Text: "Continue", Data: data(answerContinue)},
+		},
+		second,
+	})
+}
+
+// answerCallback queues the action of an answer button behind the messages of the chat
+func (s *BotTalkService) answerCallback(cb def.Callback, payload string) {
+	action, id, _ := strings.Cut(payload, ":")
+	a := s.answers.get(id)
+	if a == nil {
+		cb.Answer("This answer is too old, please ask again.")
+		return
+	}
+
+	uid := cb.GetUser().GetID()
+	cid := cb.GetChat().GetID()
+	perm := def.PermChat
+	if action == answerSpeak {
+		perm = def.PermTTS
+	}
+	if !s.accessControl.HasPermission(uid, cid, perm) {
+		cb.Answer("Sorry, you are not allowed to do this.")
+		return
+	}
+	err := s.quota.take(uid, cid)
+	if err == nil && action != answerSpeak {
+		err = s.quota.check(uid, cid, quotaTokens)
+	}
+	if err != nil {
+		cb.Answer(quotaReply(err))
+		return
+	}
+
+	priority := taskqueue.Normal
+	if s.accessControl.IsAdmin(uid) {
+		priority = taskqueue.High
+	}
+	err = s.queue.Submit(s.taskKey(cid), priority, func(work context.Context) {
+		s.runAnswerAction(work, cb, action, a)
+	})
+	if errors.Is(err, taskqueue.ErrBusy) {
+		cb.Answer(busyText)
+		return
+	}
+	cb.Answer("")
+}
+
+func (s *BotTalkService) runAnswerAction(work context.Context, cb def.Callback, action string, a *answer) {
+	uid := cb.GetUser().GetID()
+	cid := cb.GetChat().GetID()
+	reqId := logging.NewID()
+	work, span := tracing.Start(work, "handle button",
+		tracing.KeyRequest.String(reqId),
+		tracing.KeyBot.String(s.name),
+		tracing.KeyUser.String(uid.String()),
+		tracing.KeyChat.String(cid.String()),
+		attribute.String("chloe.action", action),
+	)
+	defer span.End()
+	logger := slog.With(
+		logging.KeyRequest, reqId,
+		logging.KeyBot, s.name,
+		logging.KeyUser, uid.String(),
+		logging.KeyChat, cid.String(),
+		"action", action,
+	)
+	work = logging.WithLogger(work, logger)
+	chat := tracing.Chat(work, cb.GetChat())
+
+	switch action {
+	case answerRegenerate, answerContinue:
+		talk := s.talkFact.GetTalk(a.thread)
+		stop := showAction(chat, def.ActionTyping)
+		var question, text string
+		var usage def.Usage
+		if action == answerContinue {
+			question = continuePrompt
+			text, usage = s.ask(work, chat, a.thread, a.speaker, question)
+		} else if r, ok := talk.(def.Regenerator); ok {
+			question = a.question
+			text, usage = r.Regenerate(work, question)
+		} else {
+			question = a.question
+			text, usage = s.ask(work, chat, a.thread, a.speaker, question)
+		}
+		stop()
+		s.accountChat(uid, cid, usage)
+		s.replyAnswer(chat, a.replyTo, a.thread, a.speaker, question, text)
+		logger.Info("replied", logging.Text("answer", text))
+	case answerSpeak:
+		if s.textToSpeech == nil {
+			chat.ReplyMessage("Sorry, reading aloud is not available.", cb.GetMessageID())
+			return
+		}
+		stop := showAction(chat, def.ActionRecordVoice)
+		vf, cleaner, err := s.textToSpeech.Convert(work, a.text)
+		stop()
+		if err != nil {
+			logger.Error("text to speech failed", logging.Text("text", a.text), "err", err)
+			chat.ReplyMessage("Sorry, I could not read it aloud.", cb.GetMessageID())
+			return
+		}
+		defer cleaner()
+		chat.ReplyVoice(vf, cb.GetMessageID())
+		logger.Info("voice replied")
+	case answerTranslate:
+		lang := defaultTranslateTo
+		if l, ok := cb.GetUser().(def.Localized); ok && l.GetLanguageCode() != "" {
+			lang = l.GetLanguageCode()
+		}
+		stop := showAction(chat, def.ActionTyping)
+		text, usage := s.complete(work, "", fmt.Sprintf(translatePrompt, lang, a.text))
+		stop()
+		s.accountChat(uid, cid, usage)
+		chat.ReplyMessage(text, cb.GetMessageID())
+		logger.Info("translated", "language", lang, logging.Text("answer", text))
+	default:
+		logger.Warn("unknown answer action")
+	}
+}
+
+// complete answers a single prompt apart from the conversations of the chats
+func (s *BotTalkService) complete(ctx context.Context, system, prompt string) (string, def.Usage) {
+	completer, ok := s.talkFact.(def.Completer)
+	if !ok {
+		return "Sorry, this is not available.", def.Usage{}
+	}
+	return completer.Complete(ctx, system, prompt)
+}
+
+func (s *BotTalkService) accountChat(uid def.UserID, cid def.ChatID, usage def.Usage) {
+	s.account(accounting.Record{
+		UserID:           uid,
+		ChatID:           cid,
+		Kind:             accounting.KindChat,
+		Model:            usage.Model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	})
+}
@@ -0,0 +1,76 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"chloe/def"
+	"chloe/logging"
+)
+
+// callbackHandler handles a button press, payload is the button data after "name:"
+type callbackHandler func(cb def.Callback, payload string)
+
+// listenToCallbacks handles button presses of every bot that has buttons until ctx is done
+func (s *BotTalkService) listenToCallbacks(ctx context.Context) {
+	for _, bot := range s.bots {
+		source, ok := bot.(def.CallbackSource)
+		if !ok {
+			continue
+		}
+		go func(source def.CallbackSource) {
+			for {
+				select {
+				case cb := <-source.GetCallbacks():
+					go s.handleCallback(cb)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(source)
+	}
+}
+
+func (s *BotTalkService) handleCallback(cb def.Callback) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("callback panicked", "data", cb.GetData(), "panic", r)
+		}
+	}()
+
+	name, payload, _ := strings.Cut(cb.GetData(), ":")
+	handler, exists := s.callbacks[name]
+	if !exists {
+		slog.Warn("unknown callback", "data", cb.GetData(), logging.KeyUser, cb.GetUser().GetID().String())
+		cb.Answer("")
+		return
+	}
+	handler(cb, payload)
+}
+
+// sendButtons sends text with buttons to a chat, chats without buttons get
+// the fallback text instead
+func (s *BotTalkService) sendButtons(cid def.ChatID, text, fallback string, buttons [][]def.Button) error {
+	chat := s.findChat(cid)
+	if chat == nil {
+		return s.SendMessage(cid, text)
+	}
+	if bc, ok := chat.(def.ButtonChat); ok {
+		bc.SendButtons(text, buttons)
+	} else {
+		chat.SendMessage(fallback)
+	}
+	return nil
+}
+
+// editMessage replaces the text of a message with buttons once they are used
+func editMessage(chat def.Chat, id def.MessageID, text string) {
+	if bc, ok := chat.(def.ButtonChat); ok {
+		bc.EditMessage(id, text)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"chloe/accounting"
+	"chloe/ai"
+	"chloe/command"
+	"chloe/def"
+	"chloe/logging"
+)
+
+func (s *BotTalkService) builtinCommands() []*command.Command {
+	cmds := []*command.Command{
+		{
+			Name:    "help",
+			Help:    "list the commands you can use",
+			Handler: s.helpCommand,
+		},
+		{
+			Name:       "draw",
+			Args:       "<description>",
+			Help:       "draw a 512x512 picture",
+			Permission: def.PermDraw,
+			MinArgs:    1,
+			Handler:    s.drawCommand("m"),
+		},
+		{
+			Name:       "drawbig",
+			Args:       "<description>",
+			Help:       "draw a 1024x1024 picture",
+			Permission: def.PermDraw,
+			MinArgs:    1,
+			Handler:    s.drawCommand("b"),
+		},
+		{
+			Name:       "drawsmall",
+			Args:       "<description>",
+			Help:       "draw a 256x256 picture",
+			Permission: def.PermDraw,
+			MinArgs:    1,
+			Handler:    s.drawCommand("s"),
+		},
+		{
+			Name:       "transcribe",
+			Args:       "[on|off]",
+			Help:       "reply to voice, audio and videos with the transcript only",
+			Permission: def.PermVoice,
+			Handler:    s.transcribeCommand,
+		},
+		{
+			Name:       "quota",
+			Help:       "show what you have used of your quota",
+			Permission: def.PermChat,
+			Handler:    s.quotaCommand,
+		},
+		{
+			Name:       "model",
+			Args:       "[model]",
+			Help:       "show or switch the model of this chat",
+			Permission: def.PermModel,
+			Handler:    s.modelCommand,
+		},
+		{
+			Name:       "send",
+			Args:       "<chat id> <text>",
+			Help:       "send a message to a chat as the bot",
+			Permission: def.PermAdmin,
+			MinArgs:    2,
+			Handler:    s.sendCommand,
+		},
+	}
+	cmds = append(cmds, s.scheduleCommands()...)
+	cmds = append(cmds, s.aclCommands()...)
+	return append(cmds, s.usageCommands()...)
+}
+
+// syncCommands shows the commands in the menu of IMs that support it, admin commands are left out
+func (s *BotTalkService) syncCommands() {
+	var infos []def.CommandInfo
+	for _, cmd := range s.router.Commands() {
+		if cmd.Permission == def.PermAdmin {
+			continue
+		}
+		infos = append(infos, def.CommandInfo{
+			Name:        cmd.Name,
+			Description: cmd.Help,
+		})
+	}
+
+	for _, bot := range s.bots {
+		if setter, ok := bot.(def.CommandSetter); ok {
+			if err := setter.SetCommands(infos); err != nil {
+				slog.Warn("failed to sync commands to bot", logging.KeyBot, s.name, "err", err)
+			}
+		}
+	}
+}
+
+func (s *BotTalkService) helpCommand(ctx *command.Context) {
+	ctx.Reply(s.router.Help(ctx.Allow))
+}
+
+func (s *BotTalkService) drawCommand(size string) command.Handler {
+	return func(ctx *command.Context) {
+		desc := ctx.ArgsFrom(0)
+		uid := ctx.User.GetID()
+		cid := ctx.Chat.GetID()
+		if err := s.quota.check(uid, cid, quotaImages); err != nil {
+			ctx.Reply(quotaReply(err))
+			return
+		}
+		logging.FromContext(ctx.Ctx).Debug("image requested", "size", size, logging.Text("description", desc))
+		stop := showAction(ctx.Chat, def.ActionUploadPhoto)
+		defer stop()
+		img, cleaner, err := s.images().Generate(ctx.Ctx, desc, size)
+		if err != nil {
+			ctx.Reply(err.Error())
+			return
+		}
+		s.account(accounting.Record{
+			UserID:    uid,
+			ChatID:    cid,
+			Kind:      accounting.KindImage,
+			Model:     ai.ImageModel,
+			Images:    1,
+			ImageSize: ai.ImageSize(size),
+		})
+		defer cleaner()
+		ctx.Chat.ReplyImage(img, ctx.Message.GetID())
+	}
+}
+
+func (s *BotTalkService) sendCommand(ctx *command.Context) {
+	target := def.ChatID(ctx.Arg(0))
+	if err := s.SendMessage(target, ctx.ArgsFrom(1)); err != nil {
+		logging.FromContext(ctx.Ctx).Warn("failed to send message", "target", target.String(), "err", err)
+		ctx.Reply(err.Error())
+		return
+	}
+	logging.FromContext(ctx.Ctx).Info("message sent", "target", target.String())
+	ctx.Reply("Message sent.")
+}
+
+func (s *BotTalkService) modelCommand(ctx *command.Context) {
+	selector, ok := s.talkFact.GetTalk(s.threadOf(ctx.Chat, ctx.User.GetID())).(def.ModelSelector)
+	if !ok {
+		ctx.Reply("Sorry, the model can not be changed.")
+		return
+	}
+
+	cfg := s.aiConfig()
+	models := []string{cfg.Model}
+	for _, m := range cfg.Models {
+		if m != cfg.Model {
+			models = append(models, m)
+		}
+	}
+
+	model := ctx.Arg(0)
+	if model == "" {
+		ctx.Reply(fmt.Sprintf(
+			"Current model: %s\nAvailable models: %s",
+			selector.GetModel(),
+			strings.Join(models, ", "),
+		))
+		return
+	}
+	for _, m := range models {
+		if m == model {
+			selector.SetModel(model)
+			logging.FromContext(ctx.Ctx).Info("model switched", "model", model)
+			ctx.Reply("Switched to model " + model + ".")
+			return
+		}
+	}
+	ctx.Reply(fmt.Sprintf("Unknown model %s, available models: %s", model, strings.Join(models, ", ")))
+}
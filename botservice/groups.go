@@ -0,0 +1,133 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"chloe/def"
+	"chloe/util"
+)
+
+const (
+	defaultPassiveWindow = 20
+	// older messages are no background anymore
+	overheardMaxAge = time.Hour
+)
+
+type heard struct {
+	seq    uint64
+	at     time.Time
+	remark def.Remark
+}
+
+type chatWindow struct {
+	heard []heard
+	seq   uint64
+	// the last message each thread of the chat got as background
+	seen map[def.ChatID]uint64
+}
+
+// overheard keeps the latest messages of groups that were not addressed to the bot
+type overheard struct {
+	guard sync.Mutex
+	chats map[def.ChatID]*chatWindow
+}
+
+func newOverheard() *overheard {
+	return &overheard{
+		chats: make(map[def.ChatID]*chatWindow),
+	}
+}
+
+// add keeps the remark, the oldest ones go beyond size
+func (o *overheard) add(cid def.ChatID, remark def.Remark, size int) {
+	o.guard.Lock()
+	defer o.guard.Unlock()
+
+	w, exists := o.chats[cid]
+	if !exists {
+		w = &chatWindow{seen: make(map[def.ChatID]uint64)}
+		o.chats[cid] = w
+	}
+	w.seq++
+	w.heard = append(w.heard, heard{seq: w.seq, at: time.Now(), remark: remark})
+	if len(w.heard) > size {
+		w.heard = w.heard[len(w.heard)-size:]
+	}
+}
+
+// take returns what the thread has not got yet of the chat
+func (o *overheard) take(cid, thread def.ChatID) []def.Remark {
+	o.guard.Lock()
+	defer o.guard.Unlock()
+
+	w, exists := o.chats[cid]
+	if !exists {
+		return nil
+	}
+	var remarks []def.Remark
+	for _, h := range w.heard {
+		if h.seq > w.seen[thread] && time.Since(h.at) < overheardMaxAge {
+			remarks = append(remarks, h.remark)
+		}
+	}
+	w.seen[thread] = w.seq
+	return remarks
+}
+
+func (s *BotTalkService) groupChat() util.GroupChatConfig {
+	s.guard.RLock()
+	defer s.guard.RUnlock()
+
+	return s.appConfig.GroupChat
+}
+
+func isGroup(chat def.Chat) bool {
+	return chat.GetMemberCount() > 2
+}
+
+// threadOf is the conversation of the user in the chat, with per user threads
+// every member of a group has their own
+func (s *BotTalkService) threadOf(chat def.Chat, uid def.UserID) def.ChatID {
+	if isGroup(chat) && s.groupChat().Threads == util.ThreadsUser {
+		return def.ChatID(chat.GetID().String() + "/" + uid.String())
+	}
+	return chat.GetID()
+}
+
+// speakerName is how the model calls the user in groups
+func speakerName(user def.User) string {
+	if name := user.GetFirstName(); name != "" {
+		return name
+	}
+	return user.GetUserName()
+}
+
+// overhear keeps a group message not addressed to the bot if the group is passive
+func (s *BotTalkService) overhear(chat def.Chat, user def.User, text string) {
+	cfg := s.groupChat()
+	if !cfg.Passive || text == "" {
+		return
+	}
+	size := cfg.PassiveWindow
+	if size == 0 {
+		size = defaultPassiveWindow
+	}
+	s.overheard.add(chat.GetID(), def.Remark{Speaker: speakerName(user), Text: text}, size)
+}
+
+// ask asks the thread of the chat as the user. In groups the model is told
+// who asks and what the group said meanwhile.
+func (s *BotTalkService) ask(ctx context.Context, chat def.Chat, thread def.ChatID, user def.User, q string) (string, def.Usage) {
+	talk := s.talkFact.GetTalk(thread)
+	gc, ok := talk.(def.GroupConversation)
+	if !ok || !isGroup(chat) {
+		return talk.Ask(ctx, q)
+	}
+	return gc.AskAs(ctx, speakerName(user), q, s.overheard.take(chat.GetID(), thread))
+}
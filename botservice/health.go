@@ -0,0 +1,27 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"chloe/def"
+	"chloe/metrics"
+)
+
+// registerChecks adds the adapters of the bot to the liveness checks and
+// the AI backends it depends on to the readiness checks
+func (s *BotTalkService) registerChecks(server *metrics.Server) {
+	name := s.name
+	for i, bot := range s.bots {
+		if checker, ok := bot.(def.HealthChecker); ok {
+			server.AddLiveness(name+"/"+s.adapters[i], checker.CheckHealth)
+		}
+	}
+	if checker, ok := s.talkFact.(def.HealthChecker); ok {
+		server.AddReadiness(name+"/openai", checker.CheckHealth)
+	}
+	if checker, ok := s.textToSpeech.(def.HealthChecker); ok {
+		server.AddReadiness(name+"/tts", checker.CheckHealth)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"chloe/acl"
+	"chloe/def"
+	"chloe/logging"
+	"chloe/metrics"
+	"chloe/taskqueue"
+	"chloe/util"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	// how long canceled tasks get to wind down after the shutdown timeout
+	cancelGrace = 5 * time.Second
+)
+
+const busyText = "Sorry, I am busy with other messages right now. Please try again in a moment."
+
+// Host runs every bot of the config in one process on one task queue,
+// each bot has its own conversations, acl, quota and data
+type Host struct {
+	services        []*BotTalkService
+	queue           *taskqueue.Queue
+	shutdownTimeout time.Duration
+	// nil without admin.listen
+	admin *metrics.Server
+}
+
+// NewHost sets up the bots of the config, bots without their own acl share defaultACL.
+// The adapters stop taking messages when ctx is done.
+func NewHost(ctx context.Context, config util.Config, defaultACL *acl.AccessControl) (def.BotService, error) {
+	host := &Host{
+		queue:           taskqueue.NewQueue(config.Tasks),
+		shutdownTimeout: time.Duration(config.System.ShutdownTimeout) * time.Second,
+	}
+	if host.shutdownTimeout <= 0 {
+		host.shutdownTimeout = defaultShutdownTimeout
+	}
+	if config.Admin.Listen != "" {
+		host.admin = metrics.NewServer(config.Admin.Listen)
+	}
+	defaultACL.SetDataDir(util.GetDataDir(config))
+	for _, inst := range config.Instances() {
+		accessControl := defaultACL
+		if inst.ACL != "" {
+			var err error
+			if accessControl, err = acl.Load(inst.ACL); err != nil {
+				return nil, fmt.Errorf("acl of bot %s, %v", instanceName(inst), err)
+			}
+		}
+		service := newBotTalkService(ctx, inst, accessControl)
+		service.queue = host.queue
+		if host.admin != nil {
+			service.registerChecks(host.admin)
+		}
+		host.services = append(host.services, service)
+		slog.Info("bot set up", logging.KeyBot, instanceName(inst))
+	}
+	return host, nil
+}
+
+// SendMessage sends to the chat by the first bot that has it
+func (h *Host) SendMessage(cid def.ChatID, text string) error {
+	for _, s := range h.services {
+		if s.findChat(cid) != nil {
+			return s.SendMessage(cid, text)
+		}
+	}
+	return fmt.Errorf("chat %s not found", cid.String())
+}
+
+// listenToAll queues the messages of every bot until ctx is done
+func (h *Host) listenToAll(ctx context.Context) {
+	for _, s := range h.services {
+		for _, bot := range s.bots {
+			if bot == nil {
+				continue
+			}
+			go func(s *BotTalkService, bot def.MessageBot) {
+				for {
+					select {
+					case m, ok := <-bot.GetMessages():
+						if !ok {
+							return
+						}
+						h.dispatch(s, m)
+					case <-ctx.Done():
+						return
+					}
+				}
+			}(s, bot)
+		}
+	}
+}
+
+// dispatch queues the message behind the others of its chat, admins go first.
+// When too many are waiting the sender is told to try later.
+func (h *Host) dispatch(s *BotTalkService, m def.Message) {
+	if m == nil || m.GetUser() == nil || m.GetUser().GetID() == "" || m.GetChat() == nil {
+		slog.Warn("received empty message, skip it")
+		if m == nil {
+			slog.Debug("message is nil")
+			return
+		}
+		slog.Debug("message without user or chat", "user", m.GetUser(), "chat", m.GetChat())
+		return
+	}
+
+	chat := m.GetChat()
+	priority := taskqueue.Normal
+	if s.accessControl.IsAdmin(m.GetUser().GetID()) {
+		priority = taskqueue.High
+	}
+	err := h.queue.Submit(s.taskKey(chat.GetID()), priority, s.task(m))
+	if err == nil {
+		return
+	}
+
+	discardVoice(m)
+	if !errors.Is(err, taskqueue.ErrBusy) {
+		slog.Debug("message dropped", logging.KeyChat, chat.GetID().String(), "err", err)
+		return
+	}
+	slog.Warn("task queue is full, message turned away",
+		logging.KeyBot, s.name,
+		logging.KeyChat, chat.GetID().String(),
+	)
+	// group chatter not for the bot doesn't need to know
+	if chat.GetMemberCount() <= 2 || s.isAddressed(m, m.GetText(), chat.GetSelf()) {
+		chat.ReplyMessage(busyText, m.GetID())
+	}
+}
+
+// Run handles messages until ctx is done, then waits for the tasks in hand up to the
+// shutdown timeout, cancels what is left and saves the state of every bot
+func (h *Host) Run(ctx context.Context) {
+	go h.reloadOnHangup(ctx)
+	if h.admin != nil {
+		// metrics are served until the bots are stopped, not only until ctx is done
+		adminCtx, stopAdmin := context.WithCancel(context.Background())
+		defer stopAdmin()
+		go h.admin.Run(adminCtx)
+	}
+
+	// tasks outlive ctx, they are only canceled when they take too long to drain
+	work, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	for _, s := range h.services {
+		s.start(ctx, work)
+	}
+
+	h.queue.Start(work)
+	h.listenToAll(ctx)
+	<-ctx.Done()
+
+	slog.Info("shutting down, waiting for running tasks", "timeout", h.shutdownTimeout)
+	if h.admin != nil {
+		h.admin.Stopping()
+	}
+	drained := make(chan struct{})
+	go func() {
+		h.queue.Close()
+		for _, s := range h.services {
+			s.wait()
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("running tasks finished")
+	case <-time.After(h.shutdownTimeout):
+		slog.Warn("running tasks did not finish in time, cancel them", "timeout", h.shutdownTimeout)
+		cancelWork()
+		select {
+		case <-drained:
+		case <-time.After(cancelGrace):
+			slog.Warn("canceled tasks did not finish, leave them")
+		}
+	}
+
+	for _, s := range h.services {
+		s.stop()
+	}
+}
+
+// reloadOnHangup reloads config and acl of every bot on SIGHUP until ctx is done
+func (h *Host) reloadOnHangup(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-hangup:
+			slog.Info("signal SIGHUP received, reload config and acl")
+			for _, s := range h.services {
+				go s.reloadConfig()
+				go s.reloadAccessList()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"chloe/accounting"
+	"chloe/ai"
+	"chloe/def"
+	"chloe/logging"
+	"chloe/taskqueue"
+	"chloe/tracing"
+)
+
+const (
+	// a query is only answered once the user stopped typing for this long
+	inlineDebounce = 1200 * time.Millisecond
+	// shorter queries are still being typed
+	inlineMinLength = 3
+	// queries starting with it ask for an image
+	inlineDrawPrefix = "draw "
+	inlineImageSize  = "m"
+
+	// results kept for the same query of anyone, the image links of openai expire after an hour
+	inlineCacheTTL  = 30 * time.Minute
+	inlineCacheSize = 500
+
+	// the private chat opened from a refused inline query starts with /start inline
+	inlineStartParameter = "inline"
+)
+
+// debouncer tells if a key got no newer call while waiting
+type debouncer struct {
+	guard  sync.Mutex
+	delay  time.Duration
+	seq    uint64
+	latest map[string]uint64
+}
+
+func newDebouncer(delay time.Duration) *debouncer {
+	return &debouncer{
+		delay:  delay,
+		latest: make(map[string]uint64),
+	}
+}
+
+// settle waits for the delay and tells if this is still the latest call of the key
+func (d *debouncer) settle(key string) bool {
+	d.guard.Lock()
+	d.seq++
+	mine := d.seq
+	d.latest[key] = mine
+	d.guard.Unlock()
+
+	time.Sleep(d.delay)
+
+	d.guard.Lock()
+	defer d.guard.Unlock()
+
+	if d.latest[key] != mine {
+		return false
+	}
+	delete(d.latest, key)
+	return true
+}
+
+type inlineEntry struct {
+	results []def.InlineResult
+	created time.Time
+}
+
+// inlineCache keeps the results of recent inline queries by kind and text
+type inlineCache struct {
+	guard   sync.Mutex
+	entries map[string]inlineEntry
+	// keys from the oldest to the latest
+	order []string
+}
+
+func newInlineCache() *inlineCache {
+	return &inlineCache{
+		entries: make(map[string]inlineEntry),
+	}
+}
+
+func (c *inlineCache) get(key string) ([]def.InlineResult, bool) {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+
+	e, exists := c.entries[key]
+	if !exists || time.Since(e.created) > inlineCacheTTL {
+		return nil, false
+	}
+	return e.results, true
+}
+
+func (c *inlineCache) put(key string, results []def.InlineResult) {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+
+	if _, exists := c.entries[key]; !exists {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = inlineEntry{results: results, created: time.Now()}
+	if len(c.order) > inlineCacheSize {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// listenToInlineQueries answers inline queries of every bot that has them until ctx is done
+func (s *BotTalkService) listenToInlineQueries(ctx context.Context) {
+	for _, bot := range s.bots {
+		source, ok := bot.(def.InlineSource)
+		if !ok {
+			continue
+		}
+		go func(source def.InlineSource) {
+			for {
+				select {
+				case q := <-source.GetInlineQueries():
+					go s.handleInlineQuery(q)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(source)
+	}
+}
+
+// handleInlineQuery answers the query once the user stopped typing, from the cache
+// if anyone asked the same lately, answers don't depend on who asks. The private
+// chat of the user decides the permissions and counts the query against the quota.
+func (s *BotTalkService) handleInlineQuery(q def.InlineQuery) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("inline query panicked", "panic", r)
+		}
+	}()
+
+	text := strings.TrimSpace(q.GetText())
+	uid := q.GetUser().GetID()
+	if len([]rune(text)) < inlineMinLength || !s.inlineTyping.settle(uid.String()) {
+		return
+	}
+
+	draw := len(text) > len(inlineDrawPrefix) && strings.EqualFold(text[:len(inlineDrawPrefix)], inlineDrawPrefix)
+	perm, resource := def.PermChat, quotaTokens
+	if draw {
+		text = strings.TrimSpace(text[len(inlineDrawPrefix):])
+		perm, resource = def.PermDraw, quotaImages
+	}
+	cid := def.ChatID(uid)
+	if !s.accessControl.HasPermission(uid, cid, perm) {
+		q.Refuse("You are not allowed, talk to me first", inlineStartParameter)
+		return
+	}
+
+	if err := s.quota.take(uid, cid); err != nil {
+		q.Refuse(quotaReply(err), inlineStartParameter)
+		return
+	}
+	key := string(perm) + ":" + strings.ToLower(text)
+	if results, cached := s.inlineResults.get(key); cached {
+		q.Answer(results)
+		return
+	}
+	if err := s.quota.check(uid, cid, resource); err != nil {
+		q.Refuse(quotaReply(err), inlineStartParameter)
+		return
+	}
+
+	err := s.queue.Submit(s.taskKey(def.ChatID("inline-"+uid.String())), taskqueue.Normal, func(work context.Context) {
+		reqId := logging.NewID()
+		work, span := tracing.Start(work, "handle inline query",
+			tracing.KeyRequest.String(reqId),
+			tracing.KeyBot.String(s.name),
+			tracing.KeyUser.String(uid.String()),
+		)
+		defer span.End()
+		logger := slog.With(
+			logging.KeyRequest, reqId,
+			logging.KeyBot, s.name,
+			logging.KeyUser, uid.String(),
+		)
+		work = logging.WithLogger(work, logger)
+		logger.Info("inline query received", "draw", draw, logging.Text("text", text))
+
+		var results []def.InlineResult
+		if draw {
+			results = s.inlineImage(work, uid, text)
+		} else {
+			results = s.inlineAnswer(work, uid, text)
+		}
+		if len(results) > 0 {
+			s.inlineResults.put(key, results)
+		}
+		q.Answer(results)
+	})
+	if err != nil {
+		q.Refuse(busyText, inlineStartParameter)
+	}
+}
+
+func (s *BotTalkService) inlineAnswer(work context.Context, uid def.UserID, question string) []def.InlineResult {
+	// inline answers have no history, they are cached for anyone asking the same
+	answer, usage := s.complete(work, s.aiConfig().Persona, question)
+	s.accountChat(uid, def.ChatID(uid), usage)
+	return []def.InlineResult{{
+		ID:          logging.NewID(),
+		Title:       question,
+		Description: answer,
+		Text:        answer,
+	}}
+}
+
+func (s *BotTalkService) inlineImage(work context.Context, uid def.UserID, desc string) []def.InlineResult {
+	linker, ok := s.images().(def.ImageLinker)
+	if !ok {
+		return nil
+	}
+	url, err := linker.GenerateURL(work, desc, inlineImageSize)
+	if err != nil {
+		return nil
+	}
+	s.account(accounting.Record{
+		UserID:    uid,
+		ChatID:    def.ChatID(uid),
+		Kind:      accounting.KindImage,
+		Model:     ai.ImageModel,
+		Images:    1,
+		ImageSize: ai.ImageSize(inlineImageSize),
+	})
+	return []def.InlineResult{{
+		ID:       logging.NewID(),
+		Title:    desc,
+		Text:     desc,
+		ImageURL: url,
+	}}
+}
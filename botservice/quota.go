@@ -0,0 +1,382 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"chloe/command"
+	"chloe/def"
+	"chloe/util"
+)
+
+const (
+	quotaMessages = "messages"
+	quotaTokens   = "tokens"
+	quotaImages   = "images"
+	quotaAudio    = "audio seconds"
+
+	scopeUser = "user"
+	scopeChat = "chat"
+
+	// usage is written to disk at most this often
+	quotaFlushInterval = 30 * time.Second
+)
+
+type quotaUsage struct {
+	Day     string           `json:"day"`
+	Daily   util.QuotaAmount `json:"daily"`
+	Month   string           `json:"month"`
+	Monthly util.QuotaAmount `json:"monthly"`
+}
+
+// quotaError is a rate limit or quota that is reached, reply tells the user
+// why and until when
+type quotaError struct {
+	reason string
+	reply  string
+}
+
+func (e *quotaError) Error() string {
+	return e.reason
+}
+
+// quotaReply is what the user is told about a failed take or check
+func quotaReply(err error) string {
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		return qe.reply
+	}
+	return err.Error()
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// quotaManager limits how fast and how much every user and every chat may use the bot.
+// Rate limits are token buckets kept in memory, daily and monthly usage is persisted.
+type quotaManager struct {
+	guard   sync.Mutex
+	path    string
+	enabled bool
+	groups  map[string]util.QuotaGroup
+	groupOf func(string) string
+	loc     *time.Location
+	usage   map[string]*quotaUsage
+	buckets map[string]*tokenBucket
+	dirty   bool
+}
+
+func newQuotaManager(
+	path string,
+	config util.Config,
+	groupOf func(string) string,
+	loc *time.Location,
+) *quotaManager {
+	q := &quotaManager{
+		path:    path,
+		enabled: config.Quota.Enabled,
+		groups:  config.Quota.Groups,
+		groupOf: groupOf,
+		loc:     loc,
+		usage:   make(map[string]*quotaUsage),
+		buckets: make(map[string]*tokenBucket),
+	}
+	if err := util.LoadJSON(path, &q.usage); err != nil {
+		slog.Error("failed to load quota usage", "path", path, "err", err)
+	}
+	return q
+}
+
+// setConfig applies reloaded limits, usage so far is kept
+func (q *quotaManager) setConfig(config util.Config) {
+	q.guard.Lock()
+	defer q.guard.Unlock()
+
+	q.enabled = config.Quota.Enabled
+	q.groups = config.Quota.Groups
+}
+
+// run flushes the usage regularly until ctx is done, and a last time then
+func (q *quotaManager) run(ctx context.Context) {
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.flush()
+		case <-ctx.Done():
+			q.flush()
+			return
+		}
+	}
+}
+
+func (q *quotaManager) flush() {
+	q.guard.Lock()
+	defer q.guard.Unlock()
+
+	if !q.dirty {
+		return
+	}
+	if err := util.SaveJSON(q.path, q.usage); err != nil {
+		slog.Error("failed to save quota usage", "path", q.path, "err", err)
+		return
+	}
+	q.dirty = false
+}
+
+// take counts one message against the rate limits and the message quotas of the user and the chat
+func (q *quotaManager) take(uid def.UserID, cid def.ChatID) error {
+	q.guard.Lock()
+	defer q.guard.Unlock()
+
+	now := time.Now()
+	if q.enabled {
+		userBucket := q.bucket(scopeUser, uid.String(), now)
+		chatBucket := q.bucket(scopeChat, cid.String(), now)
+		for _, b := range []struct {
+			bucket *tokenBucket
+			limits util.QuotaLimits
+			scope  string
+		}{
+			{userBucket, q.limits(scopeUser, uid.String()), scopeUser},
+			{chatBucket, q.limits(scopeChat, cid.String()), scopeChat},
+		} {
+			if b.bucket == nil || b.bucket.tokens >= 1 {
+				continue
+			}
+			wait := time.Duration((1 - b.bucket.tokens) / b.limits.RatePerMinute * float64(time.Minute)).Round(time.Second)
+			who := "You are"
+			if b.scope == scopeChat {
+				who = "This chat is"
+			}
+			return &quotaError{
+				reason: fmt.Sprintf("%s rate limit reached for %s", b.scope, wait),
+				reply:  fmt.Sprintf("%s sending messages too fast, please wait %s.", who, wait),
+			}
+		}
+
+		if err := q.exceeded(uid, cid, quotaMessages, now); err != nil {
+			return err
+		}
+		if userBucket != nil {
+			userBucket.tokens--
+		}
+		if chatBucket != nil {
+			chatBucket.tokens--
+		}
+	}
+
+	q.add(uid, cid, util.QuotaAmount{Messages: 1}, now)
+	return nil
+}
+
+// check tells if the user and the chat still have some of the resource left
+func (q *quotaManager) check(uid def.UserID, cid def.ChatID, resource string) error {
+	q.guard.Lock()
+	defer q.guard.Unlock()
+
+	if !q.enabled {
+		return nil
+	}
+	return q.exceeded(uid, cid, resource, time.Now())
+}
+
+func (q *quotaManager) record(uid def.UserID, cid def.ChatID, amount util.QuotaAmount) {
+	q.guard.Lock()
+	defer q.guard.Unlock()
+
+	q.add(uid, cid, amount, time.Now())
+}
+
+func (q *quotaManager) report(uid def.UserID, cid def.ChatID, isGroup bool) string {
+	q.guard.Lock()
+	defer q.guard.Unlock()
+
+	now := time.Now()
+	var sb strings.Builder
+	scopes := []struct {
+		title string
+		scope string
+		id    string
+	}{
+		{"Your", scopeUser, uid.String()},
+	}
+	if isGroup {
+		scopes = append(scopes, struct {
+			title string
+			scope string
+			id    string
+		}{"This chat's", scopeChat, cid.String()})
+	}
+
+	for _, sc := range scopes {
+		usage := q.current(sc.scope, sc.id, now)
+		limits := util.QuotaLimits{}
+		if q.enabled {
+			limits = q.limits(sc.scope, sc.id)
+		}
+		fmt.Fprintf(&sb, "%s usage today: %s\n", sc.title, formatQuota(usage.Daily, limits.Daily))
+		fmt.Fprintf(&sb, "%s usage this month: %s\n", sc.title, formatQuota(usage.Monthly, limits.Monthly))
+	}
+	return sb.String()
+}
+
+// exceeded must be called with guard held
+func (q *quotaManager) exceeded(uid def.UserID, cid def.ChatID, resource string, now time.Time) error {
+	now = now.In(q.loc)
+	for _, sc := range []struct {
+		scope string
+		id    string
+		owner string
+	}{
+		{scopeUser, uid.String(), "Your"},
+		{scopeChat, cid.String(), "This chat's"},
+	} {
+		limits := q.limits(sc.scope, sc.id)
+		usage := q.current(sc.scope, sc.id, now)
+
+		if used, limit := quotaOf(usage.Daily, resource), quotaOf(limits.Daily, resource); limit > 0 && used >= limit {
+			tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, q.loc)
+			return &quotaError{
+				reason: fmt.Sprintf("%s daily quota of %g %s used up", sc.scope, limit, resource),
+				reply: fmt.Sprintf("%s daily quota of %g %s is used up, it resets at %s.",
+					sc.owner, limit, resource, tomorrow.Format("2006-01-02 15:04")),
+			}
+		}
+		if used, limit := quotaOf(usage.Monthly, resource), quotaOf(limits.Monthly, resource); limit > 0 && used >= limit {
+			nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, q.loc)
+			return &quotaError{
+				reason: fmt.Sprintf("%s monthly quota of %g %s used up", sc.scope, limit, resource),
+				reply: fmt.Sprintf("%s monthly quota of %g %s is used up, it resets at %s.",
+					sc.owner, limit, resource, nextMonth.Format("2006-01-02 15:04")),
+			}
+		}
+	}
+	return nil
+}
+
+// add must be called with guard held
+func (q *quotaManager) add(uid def.UserID, cid def.ChatID, amount util.QuotaAmount, now time.Time) {
+	for _, key := range []struct {
+		scope string
+		id    string
+	}{
+		{scopeUser, uid.String()},
+		{scopeChat, cid.String()},
+	} {
+		usage := q.current(key.scope, key.id, now)
+		addQuota(&usage.Daily, amount)
+		addQuota(&usage.Monthly, amount)
+	}
+	q.dirty = true
+}
+
+// current returns the usage of the running day and month, must be called with guard held
+func (q *quotaManager) current(scope, id string, now time.Time) *quotaUsage {
+	key := scope + ":" + id
+	usage, exists := q.usage[key]
+	if !exists {
+		usage = &quotaUsage{}
+		q.usage[key] = usage
+	}
+
+	now = now.In(q.loc)
+	if day := now.Format("2006-01-02"); usage.Day != day {
+		usage.Day = day
+		usage.Daily = util.QuotaAmount{}
+	}
+	if month := now.Format("2006-01"); usage.Month != month {
+		usage.Month = month
+		usage.Monthly = util.QuotaAmount{}
+	}
+	return usage
+}
+
+func (q *quotaManager) limits(scope, id string) util.QuotaLimits {
+	group, exists := q.groups[q.groupOf(id)]
+	if !exists {
+		group = q.groups[util.DefaultGroup]
+	}
+	if scope == scopeUser {
+		return group.User
+	}
+	return group.Chat
+}
+
+// bucket refills and returns the token bucket, nil if there is no rate limit.
+// must be called with guard held
+func (q *quotaManager) bucket(scope, id string, now time.Time) *tokenBucket {
+	limits := q.limits(scope, id)
+	if limits.RatePerMinute <= 0 {
+		return nil
+	}
+	capacity := float64(limits.Burst)
+	if capacity < 1 {
+		capacity = math.Max(1, math.Ceil(limits.RatePerMinute))
+	}
+
+	key := scope + ":" + id
+	b, exists := q.buckets[key]
+	if !exists {
+		b = &tokenBucket{
+			tokens: capacity,
+			last:   now,
+		}
+		q.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Minutes()*limits.RatePerMinute)
+	b.last = now
+	return b
+}
+
+func quotaOf(amount util.QuotaAmount, resource string) float64 {
+	switch resource {
+	case quotaMessages:
+		return float64(amount.Messages)
+	case quotaTokens:
+		return float64(amount.Tokens)
+	case quotaImages:
+		return float64(amount.Images)
+	case quotaAudio:
+		return amount.AudioSeconds
+	default:
+		return 0
+	}
+}
+
+func addQuota(total *util.QuotaAmount, amount util.QuotaAmount) {
+	total.Messages += amount.Messages
+	total.Tokens += amount.Tokens
+	total.Images += amount.Images
+	total.AudioSeconds += amount.AudioSeconds
+}
+
+func formatQuota(used, limits util.QuotaAmount) string {
+	var parts []string
+	for _, resource := range []string{quotaMessages, quotaTokens, quotaImages, quotaAudio} {
+		u, l := quotaOf(used, resource), quotaOf(limits, resource)
+		if l > 0 {
+			parts = append(parts, fmt.Sprintf("%.0f/%.0f %s", u, l, resource))
+		} else {
+			parts = append(parts, fmt.Sprintf("%.0f %s", u, resource))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s *BotTalkService) quotaCommand(ctx *command.Context) {
+	ctx.Reply(s.quota.report(ctx.User.GetID(), ctx.Chat.GetID(), ctx.Chat.GetMemberCount() > 2))
+}
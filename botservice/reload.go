@@ -0,0 +1,203 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"chloe/ai"
+	"chloe/def"
+	"chloe/logging"
+	"chloe/util"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// editors write a file in several steps, wait for them to settle
+const reloadDelay = 500 * time.Millisecond
+
+func aiConfigOf(config util.Config) ai.AIConfig {
+	return ai.AIConfig{
+		BotName:        config.BotName,
+		Model:          config.OpenAI.Model,
+		ApiKey:         config.OpenAI.APIKey,
+		ContextTimeout: config.OpenAI.ContextTimeout,
+		Models:         config.OpenAI.Models,
+		Persona:        config.Persona,
+	}
+}
+
+func (s *BotTalkService) aiConfig() ai.AIConfig {
+	s.guard.RLock()
+	defer s.guard.RUnlock()
+
+	return s.config
+}
+
+func (s *BotTalkService) speech() def.SpeechToText {
+	s.guard.RLock()
+	defer s.guard.RUnlock()
+
+	return s.speechToText
+}
+
+func (s *BotTalkService) images() def.ImageGenerator {
+	s.guard.RLock()
+	defer s.guard.RUnlock()
+
+	return s.imageGenerator
+}
+
+// watchConfig reloads config.yml and acl.yml when they change. The directories are
+// watched, not the files, since editors and atomic writes replace the file.
+func (s *BotTalkService) watchConfig(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("failed to watch config files, reload by SIGHUP only", "err", err)
+		return
+	}
+	defer watcher.Close()
+
+	s.guard.RLock()
+	configPath := s.appConfig.Path
+	s.guard.RUnlock()
+	aclPath := s.accessControl.Path()
+	reloads := map[string]func(){
+		configPath: s.reloadConfig,
+	}
+	if aclPath != "" {
+		reloads[aclPath] = s.reloadAccessList
+	}
+	watchFiles(ctx, watcher, addWatches(watcher, reloads))
+}
+
+// addWatches watches the directories of the files, it returns the reloads by absolute
+// path since fsnotify names a changed file by the directory it watches
+func addWatches(watcher *fsnotify.Watcher, reloads map[string]func()) map[string]func() {
+	watched := make(map[string]func(), len(reloads))
+	for path, reload := range reloads {
+		path = absPath(path)
+		watched[path] = reload
+		dir := filepath.Dir(path)
+		if err := watcher.Add(dir); err != nil {
+			slog.Error("failed to watch config dir", "path", dir, "err", err)
+		}
+	}
+	return watched
+}
+
+// watchFiles calls the reload of a file once it settled after a change, until ctx is done
+func watchFiles(ctx context.Context, watcher *fsnotify.Watcher, reloads map[string]func()) {
+	timers := make(map[string]*time.Timer)
+	for {
+		select {
+		case <-ctx.Done():
+			for _, t := range timers {
+				t.Stop()
+			}
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			path := absPath(event.Name)
+			reload, watched := reloads[path]
+			if !watched {
+				continue
+			}
+			if t, exists := timers[path]; exists {
+				t.Stop()
+			}
+			timers[path] = time.AfterFunc(reloadDelay, reload)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("config watcher error", "err", err)
+		}
+	}
+}
+
+// absPath makes paths given in different ways comparable
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// reloadConfig swaps in a valid config.yml, tasks already running finish with the old settings
+func (s *BotTalkService) reloadConfig() {
+	s.guard.RLock()
+	old := s.appConfig
+	s.guard.RUnlock()
+	path := old.Path
+
+	loaded, err := util.LoadConfig(path)
+	if err != nil {
+		slog.Error("config not reloaded, keep running with the old one", "path", path, "err", err)
+		return
+	}
+	config, found := loaded.Bot(old.Instance)
+	if !found {
+		slog.Warn("bot is gone from config, it stops after a restart", logging.KeyBot, old.Instance, "path", path)
+		return
+	}
+
+	logging.AddSecrets(config.Secrets()...)
+	logging.Reconfigure(config.Log)
+	aicfg := aiConfigOf(config)
+	s.guard.Lock()
+	s.appConfig = config
+	s.config = aicfg
+	if config.OpenAI.APIKey != old.OpenAI.APIKey {
+		s.speechToText = ai.NewSpeech2Text(aicfg.ApiKey)
+		s.imageGenerator = ai.NewImageGenerator(aicfg.ApiKey)
+	}
+	s.guard.Unlock()
+
+	if r, ok := s.talkFact.(interface{ Reconfigure(ai.AIConfig) }); ok {
+		r.Reconfigure(aicfg)
+	}
+	s.accessControl.SetWhitelist(config.System.WhitelistEnabled)
+	s.quota.setConfig(config)
+	s.media.Reconfigure(config.Media)
+
+	for name, changed := range map[string]bool{
+		"telegram.botToken":    config.Telegram.BotToken != old.Telegram.BotToken,
+		"telegram.voiceFormat": config.Telegram.VoiceFormat != old.Telegram.VoiceFormat,
+		"remote.port":          config.Remote.Port != old.Remote.Port,
+		"admin.listen":         config.Admin.Listen != old.Admin.Listen,
+		"log.format":           config.Log.Format != old.Log.Format,
+		"log.outputs":          !reflect.DeepEqual(config.Log.Outputs, old.Log.Outputs),
+		"tracing":              config.Tracing != old.Tracing,
+		"tasks":                config.Tasks != old.Tasks,
+		"acl":                  config.ACL != old.ACL,
+		"system.dataDir":       config.System.DataDir != old.System.DataDir,
+		"system.timeZone":      config.System.TimeZone != old.System.TimeZone,
+		"pipeline.stages":      !reflect.DeepEqual(config.Pipeline.Stages, old.Pipeline.Stages),
+		"pricing":              !reflect.DeepEqual(config.Pricing, old.Pricing),
+	} {
+		if changed {
+			slog.Warn("setting changed, it takes effect after a restart", "setting", name)
+		}
+	}
+	slog.Info("config reloaded", "path", path, logging.KeyBot, instanceName(config))
+}
+
+func (s *BotTalkService) reloadAccessList() {
+	if err := s.accessControl.Reload(); err != nil {
+		slog.Error("acl not reloaded, keep running with the old one", "path", s.accessControl.Path(), "err", err)
+		return
+	}
+	slog.Info("acl reloaded", "path", s.accessControl.Path())
+}
@@ -0,0 +1,48 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestWatchFilesReloads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(path, []byte("botName: chloe\n"), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatalf("new watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	reloaded := make(chan struct{}, 1)
+	// the path is given the way a user may type it, not clean
+	given := dir + string(filepath.Separator) + "." + string(filepath.Separator) + "config.yml"
+	reloads := addWatches(watcher, map[string]func(){
+		given: func() { reloaded <- struct{}{} },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchFiles(ctx, watcher, reloads)
+
+	if err := os.WriteFile(path, []byte("botName: zoe\n"), 0600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(reloadDelay + 5*time.Second):
+		t.Fatal("config not reloaded after it changed")
+	}
+}
@@ -0,0 +1,588 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chloe/command"
+	"chloe/def"
+	"chloe/logging"
+	"chloe/tracing"
+	"chloe/util"
+
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	jobRemind = "remind"
+	jobEvery  = "every"
+
+	maxJobsPerChat = 20
+	// default clock for reminders given only a day, like "tomorrow"
+	defaultRemindHour = 9
+	// the longest the scheduler sleeps, so a changed wall clock is noticed
+	maxSchedulerSleep = time.Hour
+)
+
+const (
+	remindUsage = "Usage: /remind <when> <text>\n" +
+		"when can be: 10m, 2h30m, 3d, 18:30, 9pm, tomorrow 9:00, 2024-05-01 14:00"
+	everyUsage = "Usage: /every <cron> <prompt>\n" +
+		"cron is a 5 field expression like \"0 9 * * *\" or a descriptor like @daily"
+)
+
+type scheduledJob struct {
+	ID       int64      `json:"id"`
+	Kind     string     `json:"kind"`
+	ChatID   def.ChatID `json:"chatId"`
+	UserID   def.UserID `json:"userId"`
+	UserName string     `json:"userName,omitempty"`
+	Text     string     `json:"text"`
+	Cron     string     `json:"cron,omitempty"`
+	Next     time.Time  `json:"next"`
+	Created  time.Time  `json:"created"`
+}
+
+type jobFile struct {
+	LastID int64           `json:"lastId"`
+	Jobs   []*scheduledJob `json:"jobs"`
+}
+
+// scheduler keeps reminders and periodic prompts in a json file and fires them on time,
+// jobs missed while the bot was down fire once as soon as it starts again
+type scheduler struct {
+	guard  sync.Mutex
+	path   string
+	lastId int64
+	jobs   map[int64]*scheduledJob
+	loc    *time.Location
+	fire   func(context.Context, scheduledJob)
+	wake   chan struct{}
+	// jobs being fired
+	running sync.WaitGroup
+}
+
+func newScheduler(path string, loc *time.Location, fire func(context.Context, scheduledJob)) *scheduler {
+	sch := &scheduler{
+		path: path,
+		jobs: make(map[int64]*scheduledJob),
+		loc:  loc,
+		fire: fire,
+		wake: make(chan struct{}, 1),
+	}
+
+	var saved jobFile
+	if err := util.LoadJSON(path, &saved); err != nil {
+		slog.Error("failed to load scheduled jobs", "path", path, "err", err)
+	}
+	sch.lastId = saved.LastID
+	for _, job := range saved.Jobs {
+		sch.jobs[job.ID] = job
+	}
+	slog.Info("scheduled jobs loaded", "jobs", len(sch.jobs), "path", path)
+
+	return sch
+}
+
+// run fires the jobs on time until ctx is done, the jobs run with work
+func (sch *scheduler) run(ctx, work context.Context) {
+	for {
+		due, wait := sch.popDue(time.Now())
+		for _, job := range due {
+			sch.running.Add(1)
+			go func(job scheduledJob) {
+				defer sch.running.Done()
+				sch.fire(work, job)
+			}(job)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-sch.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// wait blocks until the jobs being fired are done
+func (sch *scheduler) wait() {
+	sch.running.Wait()
+}
+
+// popDue takes out the jobs due at now, reschedules the periodic ones,
+// and returns how long to wait for the next job
+func (sch *scheduler) popDue(now time.Time) ([]scheduledJob, time.Duration) {
+	sch.guard.Lock()
+	defer sch.guard.Unlock()
+
+	var due []scheduledJob
+	for id, job := range sch.jobs {
+		if job.Next.After(now) {
+			continue
+		}
+		due = append(due, *job)
+
+		if job.Kind != jobEvery {
+			delete(sch.jobs, id)
+			continue
+		}
+		schedule, err := cron.ParseStandard(job.Cron)
+		if err != nil {
+			slog.Error("invalid cron of job, removed", "job", id, "cron", job.Cron, "err", err)
+			delete(sch.jobs, id)
+			continue
+		}
+		job.Next = schedule.Next(now.In(sch.loc))
+	}
+	if len(due) > 0 {
+		sch.save()
+	}
+
+	wait := maxSchedulerSleep
+	for _, job := range sch.jobs {
+		if d := job.Next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return due, wait
+}
+
+func (sch *scheduler) add(job *scheduledJob) (int64, error) {
+	sch.guard.Lock()
+	defer sch.guard.Unlock()
+
+	count := 0
+	for _, j := range sch.jobs {
+		if j.ChatID == job.ChatID {
+			count++
+		}
+	}
+	if count >= maxJobsPerChat {
+		return 0, fmt.Errorf("this chat already has %d scheduled jobs, cancel some first", count)
+	}
+
+	sch.lastId++
+	job.ID = sch.lastId
+	job.Created = time.Now()
+	sch.jobs[job.ID] = job
+	sch.save()
+	sch.notify()
+
+	return job.ID, nil
+}
+
+func (sch *scheduler) get(id int64) (scheduledJob, bool) {
+	sch.guard.Lock()
+	defer sch.guard.Unlock()
+
+	job, exists := sch.jobs[id]
+	if !exists {
+		return scheduledJob{}, false
+	}
+	return *job, true
+}
+
+func (sch *scheduler) remove(id int64) {
+	sch.guard.Lock()
+	defer sch.guard.Unlock()
+
+	delete(sch.jobs, id)
+	sch.save()
+	sch.notify()
+}
+
+// list returns the jobs of the chat ordered by the next fire time
+func (sch *scheduler) list(cid def.ChatID) []scheduledJob {
+	sch.guard.Lock()
+	defer sch.guard.Unlock()
+
+	var jobs []scheduledJob
+	for _, job := range sch.jobs {
+		if job.ChatID == cid {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Next.Before(jobs[j].Next)
+	})
+	return jobs
+}
+
+// save must be called with guard held
+func (sch *scheduler) save() {
+	saved := jobFile{
+		LastID: sch.lastId,
+	}
+	for _, job := range sch.jobs {
+		saved.Jobs = append(saved.Jobs, job)
+	}
+	sort.Slice(saved.Jobs, func(i, j int) bool {
+		return saved.Jobs[i].ID < saved.Jobs[j].ID
+	})
+
+	if err := util.SaveJSON(sch.path, saved); err != nil {
+		slog.Error("failed to save scheduled jobs", "path", sch.path, "err", err)
+	}
+}
+
+func (sch *scheduler) notify() {
+	select {
+	case sch.wake <- struct{}{}:
+	default:
+	}
+}
+
+// parseRemind splits "/remind" arguments into the time to fire and the reminder text
+func parseRemind(args string, now time.Time) (time.Time, string, error) {
+	tok, rest := nextToken(args)
+	if tok == "in" {
+		tok, rest = nextToken(rest)
+	}
+
+	var at time.Time
+	if d, ok := parseDuration(tok); ok {
+		at = now.Add(d)
+	} else {
+		var day time.Time
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		explicitDay := true
+		switch strings.ToLower(tok) {
+		case "today":
+			day = today
+		case "tomorrow":
+			day = today.AddDate(0, 0, 1)
+		default:
+			if d, err := time.ParseInLocation("2006-01-02", tok, now.Location()); err == nil {
+				day = d
+			} else {
+				// no day given, the token has to be the clock
+				day = today
+				explicitDay = false
+				rest = tok + " " + rest
+			}
+		}
+
+		hour, minute := defaultRemindHour, 0
+		clock, clockRest := nextToken(rest)
+		if strings.EqualFold(clock, "at") {
+			clock, clockRest = nextToken(clockRest)
+		}
+		if h, m, ok := parseClock(clock); ok {
+			hour, minute = h, m
+			rest = clockRest
+		} else if !explicitDay {
+			return time.Time{}, "", errors.New(remindUsage)
+		}
+
+		at = time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, now.Location())
+		if !explicitDay && !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+	}
+
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(strings.ToLower(rest), "to ") {
+		rest = strings.TrimSpace(rest[3:])
+	}
+	if rest == "" {
+		return time.Time{}, "", errors.New(remindUsage)
+	}
+	if !at.After(now) {
+		return time.Time{}, "", errors.New("the reminder time is already in the past")
+	}
+	return at, rest, nil
+}
+
+// parseEvery splits "/every" arguments into the cron spec and the prompt
+func parseEvery(args string) (string, string, error) {
+	args = strings.TrimSpace(args)
+	var spec, prompt string
+	if strings.HasPrefix(args, "@") {
+		spec, prompt = nextToken(args)
+	} else {
+		fields := strings.Fields(args)
+		if len(fields) <= 5 {
+			return "", "", errors.New(everyUsage)
+		}
+		spec = strings.Join(fields[:5], " ")
+		prompt = args
+		for i := 0; i < 5; i++ {
+			_, prompt = nextToken(prompt)
+		}
+	}
+
+	prompt = strings.TrimSpace(prompt)
+	if prompt == "" {
+		return "", "", errors.New(everyUsage)
+	}
+	if _, err := cron.ParseStandard(spec); err != nil {
+		return "", "", fmt.Errorf("invalid cron expression '%s', %v\n%s", spec, err, everyUsage)
+	}
+	return spec, prompt, nil
+}
+
+// nextToken returns the first whitespace separated token and the rest of s untouched
+func nextToken(s string) (string, string) {
+	s = strings.TrimLeft(s, " \t\n")
+	if i := strings.IndexAny(s, " \t\n"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// parseDuration accepts go durations like 1h30m and additionally days like 3d
+func parseDuration(s string) (time.Duration, bool) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || days <= 0 {
+			return 0, false
+		}
+		return time.Duration(days) * 24 * time.Hour, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// parseClock accepts 9, 9:30, 21:30, 9pm and 9:30am
+func parseClock(s string) (int, int, bool) {
+	s = strings.ToLower(s)
+	am, pm := strings.HasSuffix(s, "am"), strings.HasSuffix(s, "pm")
+	if am || pm {
+		s = s[:len(s)-2]
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minute := 0
+	if len(parts) == 2 {
+		if minute, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, false
+		}
+	}
+
+	if am || pm {
+		if hour < 1 || hour > 12 {
+			return 0, 0, false
+		}
+		if pm && hour < 12 {
+			hour += 12
+		}
+		if am && hour == 12 {
+			hour = 0
+		}
+	}
+	if hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, 0, false
+	}
+	return hour, minute, true
+}
+
+func (s *BotTalkService) scheduleCommands() []*command.Command {
+	return []*command.Command{
+		{
+			Name:       "remind",
+			Args:       "<when> <text>",
+			Help:       "remind you at a time, like /remind tomorrow 9:00 call mom",
+			Permission: def.PermChat,
+			MinArgs:    2,
+			Handler:    s.remindCommand,
+		},
+		{
+			Name:       "every",
+			Args:       "<cron> <prompt>",
+			Help:       "ask the prompt periodically and post the answer here",
+			Permission: def.PermChat,
+			MinArgs:    2,
+			Handler:    s.everyCommand,
+		},
+		{
+			Name:       "jobs",
+			Help:       "list scheduled jobs in this chat",
+			Permission: def.PermChat,
+			Handler:    s.jobsCommand,
+		},
+		{
+			Name:       "cancel",
+			Args:       "<job id>",
+			Help:       "cancel a scheduled job",
+			Permission: def.PermChat,
+			MinArgs:    1,
+			Handler:    s.cancelCommand,
+		},
+	}
+}
+
+func (s *BotTalkService) remindCommand(ctx *command.Context) {
+	uid := ctx.User.GetID()
+	cid := ctx.Chat.GetID()
+
+	at, text, err := parseRemind(ctx.RawArgs, time.Now().In(s.scheduler.loc))
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	id, err := s.scheduler.add(&scheduledJob{
+		Kind:     jobRemind,
+		ChatID:   cid,
+		UserID:   uid,
+		UserName: ctx.User.GetUserName(),
+		Text:     text,
+		Next:     at,
+	})
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	logging.FromContext(ctx.Ctx).Info("reminder added", "job", id, "at", at)
+	ctx.Reply(fmt.Sprintf("OK, I will remind you at %s. (job #%d)", at.Format("2006-01-02 15:04"), id))
+}
+
+func (s *BotTalkService) everyCommand(ctx *command.Context) {
+	uid := ctx.User.GetID()
+	cid := ctx.Chat.GetID()
+
+	spec, prompt, err := parseEvery(ctx.RawArgs)
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	schedule, _ := cron.ParseStandard(spec)
+	next := schedule.Next(time.Now().In(s.scheduler.loc))
+	id, err := s.scheduler.add(&scheduledJob{
+		Kind:     jobEvery,
+		ChatID:   cid,
+		UserID:   uid,
+		UserName: ctx.User.GetUserName(),
+		Text:     prompt,
+		Cron:     spec,
+		Next:     next,
+	})
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	logging.FromContext(ctx.Ctx).Info("periodic job added", "job", id, "cron", spec)
+	ctx.Reply(fmt.Sprintf("OK, first run at %s. (job #%d)", next.Format("2006-01-02 15:04"), id))
+}
+
+func (s *BotTalkService) jobsCommand(ctx *command.Context) {
+	jobs := s.scheduler.list(ctx.Chat.GetID())
+	if len(jobs) == 0 {
+		ctx.Reply("There are no scheduled jobs in this chat.")
+		return
+	}
+
+	var sb strings.Builder
+	for _, job := range jobs {
+		next := job.Next.In(s.scheduler.loc).Format("2006-01-02 15:04")
+		if job.Kind == jobEvery {
+			fmt.Fprintf(&sb, "#%d every '%s', next %s: %s\n", job.ID, job.Cron, next, job.Text)
+		} else {
+			fmt.Fprintf(&sb, "#%d remind at %s: %s\n", job.ID, next, job.Text)
+		}
+	}
+	ctx.Reply(sb.String())
+}
+
+func (s *BotTalkService) cancelCommand(ctx *command.Context) {
+	uid := ctx.User.GetID()
+	cid := ctx.Chat.GetID()
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(ctx.Arg(0), "#"), 10, 64)
+	if err != nil {
+		ctx.ReplyUsage()
+		return
+	}
+	job, exists := s.scheduler.get(id)
+	if !exists || job.ChatID != cid {
+		ctx.Reply(fmt.Sprintf("Job #%d not found in this chat.", id))
+		return
+	}
+	if job.UserID != uid && !ctx.Allow(def.PermAdmin) {
+		ctx.Reply("Sorry, only the creator of the job or an administrator can cancel it.")
+		return
+	}
+	s.scheduler.remove(id)
+	logging.FromContext(ctx.Ctx).Info("job canceled", "job", id)
+	ctx.Reply(fmt.Sprintf("Job #%d canceled.", id))
+}
+
+func (s *BotTalkService) fireJob(ctx context.Context, job scheduledJob) {
+	ctx, span := tracing.Start(ctx, "run job",
+		tracing.KeyBot.String(s.name),
+		tracing.KeyChat.String(job.ChatID.String()),
+		attribute.Int64("chloe.job", job.ID),
+	)
+	defer span.End()
+	logger := slog.With(
+		logging.KeyRequest, logging.NewID(),
+		logging.KeyBot, s.name,
+		logging.KeyChat, job.ChatID.String(),
+		"job", job.ID,
+	)
+	if traceId := tracing.TraceID(ctx); traceId != "" {
+		logger = logger.With(logging.KeyTrace, traceId)
+	}
+	ctx = logging.WithLogger(ctx, logger)
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("job panicked", "panic", r)
+		}
+	}()
+
+	var text string
+	switch job.Kind {
+	case jobRemind:
+		text = "Reminder: " + job.Text
+		if job.UserName != "" {
+			text = "Reminder for @" + job.UserName + ": " + job.Text
+		}
+	case jobEvery:
+		// a user who may no longer chat takes their periodic jobs with them
+		if !s.accessControl.HasPermission(job.UserID, job.ChatID, def.PermChat) {
+			s.scheduler.remove(job.ID)
+			logger.Info("job removed, its user may no longer chat", logging.KeyUser, job.UserID.String())
+			return
+		}
+		// every periodic job talks in its own conversation so it doesn't mix into the chat
+		if err := s.quota.check(job.UserID, job.ChatID, quotaTokens); err != nil {
+			text = fmt.Sprintf("Scheduled job #%d skipped. %s", job.ID, quotaReply(err))
+			break
+		}
+		talk := s.talkFact.GetTalk(def.ChatID(fmt.Sprintf("job-%d", job.ID)))
+		var usage def.Usage
+		text, usage = talk.Ask(ctx, job.Text)
+		s.accountChat(job.UserID, job.ChatID, usage)
+	default:
+		logger.Warn("unknown job kind", "kind", job.Kind)
+		return
+	}
+
+	if err := s.SendMessage(job.ChatID, text); err != nil {
+		logger.Warn("failed to deliver job", "err", err)
+		return
+	}
+	logger.Info("job fired")
+}
@@ -0,0 +1,151 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chloe/acl"
+	"chloe/def"
+)
+
+// countingTalks counts the conversations asked for, it has none to give
+type countingTalks struct {
+	asked int
+}
+
+func (f *countingTalks) GetTalk(def.ChatID) def.Conversation {
+	f.asked++
+	return nil
+}
+
+func TestParseRemind(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC)
+	day := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	for _, c := range []struct {
+		args string
+		at   time.Time
+		text string
+	}{
+		{"10m drink water", now.Add(10 * time.Minute), "drink water"},
+		{"in 2h30m to call mom", now.Add(150 * time.Minute), "call mom"},
+		{"3d renew the domain", now.Add(72 * time.Hour), "renew the domain"},
+		{"16:00 tea", day(3, 10, 16, 0), "tea"},
+		{"at 9pm tea", day(3, 10, 21, 0), "tea"},
+		// the clock passed today, so it is tomorrow
+		{"14:00 tea", day(3, 11, 14, 0), "tea"},
+		{"9:30am standup", day(3, 11, 9, 30), "standup"},
+		{"tomorrow 9:30 standup", day(3, 11, 9, 30), "standup"},
+		{"tomorrow at 9pm party", day(3, 11, 21, 0), "party"},
+		{"Tomorrow buy milk", day(3, 11, defaultRemindHour, 0), "buy milk"},
+		{"2026-04-01 12:00 prank", day(4, 1, 12, 0), "prank"},
+		{"today 18:00 to leave", day(3, 10, 18, 0), "leave"},
+	} {
+		at, text, err := parseRemind(c.args, now)
+		if err != nil {
+			t.Errorf("%q: %v", c.args, err)
+			continue
+		}
+		if !at.Equal(c.at) || text != c.text {
+			t.Errorf("%q: got %v %q, want %v %q", c.args, at, text, c.at, c.text)
+		}
+	}
+}
+
+func TestParseRemindFails(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC)
+	for _, args := range []string{
+		"",
+		"10m",
+		"tomorrow 9:30",
+		"buy milk",
+		"25:00 late",
+		"0m now",
+		// an explicit day is not moved to tomorrow
+		"today 14:00 tea",
+		"2020-01-01 12:00 old",
+	} {
+		if at, text, err := parseRemind(args, now); err == nil {
+			t.Errorf("%q: got %v %q, want an error", args, at, text)
+		}
+	}
+}
+
+func TestParseEvery(t *testing.T) {
+	for _, c := range []struct {
+		args   string
+		spec   string
+		prompt string
+	}{
+		{"0 9 * * * summarize the news", "0 9 * * *", "summarize the news"},
+		{"30 18 * * 1-5   what is for dinner?", "30 18 * * 1-5", "what is for dinner?"},
+		{"@daily tell a joke", "@daily", "tell a joke"},
+		{" @weekly  plan the week ", "@weekly", "plan the week"},
+	} {
+		spec, prompt, err := parseEvery(c.args)
+		if err != nil {
+			t.Errorf("%q: %v", c.args, err)
+			continue
+		}
+		if spec != c.spec || prompt != c.prompt {
+			t.Errorf("%q: got %q %q, want %q %q", c.args, spec, prompt, c.spec, c.prompt)
+		}
+	}
+}
+
+func TestParseEveryFails(t *testing.T) {
+	for _, args := range []string{
+		"",
+		"0 9 * *",
+		"0 9 * * *",
+		"@daily",
+		"99 9 * * * too late",
+		"@sometimes maybe",
+	} {
+		if spec, prompt, err := parseEvery(args); err == nil {
+			t.Errorf("%q: got %q %q, want an error", args, spec, prompt)
+		}
+	}
+}
+
+func TestEveryDroppedWithoutPermission(t *testing.T) {
+	accessControl, err := acl.New(acl.Policy{
+		Defaults: map[string]string{"tg": acl.RoleMember},
+		Users:    map[string]string{"tg-2": acl.RoleBanned},
+	})
+	if err != nil {
+		t.Fatalf("new acl: %v", err)
+	}
+	sch := newScheduler(filepath.Join(t.TempDir(), "jobs.json"), time.UTC, nil)
+	talks := &countingTalks{}
+	s := &BotTalkService{accessControl: accessControl, scheduler: sch, talkFact: talks}
+
+	id, err := sch.add(&scheduledJob{
+		Kind:   jobEvery,
+		ChatID: "tg--100",
+		UserID: "tg-2",
+		Text:   "tell a joke",
+		Cron:   "@daily",
+		Next:   time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("add job: %v", err)
+	}
+	job, _ := sch.get(id)
+	s.fireJob(context.Background(), job)
+
+	if talks.asked != 0 {
+		t.Error("job of a banned user asked the ai")
+	}
+	if _, exists := sch.get(id); exists {
+		t.Error("job of a banned user kept")
+	}
+}
@@ -5,230 +5,302 @@
 package botservice
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"os/signal"
+	"io"
+	"log/slog"
 	"path/filepath"
-	"regexp"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 
+	"chloe/accounting"
+	"chloe/acl"
 	"chloe/ai"
+	"chloe/command"
 	"chloe/def"
 	"chloe/im"
+	"chloe/logging"
+	"chloe/media"
+	"chloe/metrics"
+	"chloe/pipeline"
+	"chloe/taskqueue"
+	"chloe/tracing"
 	"chloe/util"
-
-	"github.com/DiamondGo/gohelper"
-	log "github.com/jeanphorn/log4go"
 )
 
 var puncs = []string{",", ".", "，", "。", "!", "?", "！", "？"}
 
 type BotTalkService struct {
-	bots           []def.MessageBot
+	// name of the bot in logs, traces and task keys, it doesn't change on reloads
+	name string
+	// guards the settings swapped in by config reloads
+	guard     sync.RWMutex
+	appConfig util.Config
+	bots      []def.MessageBot
+	// adapter names of the bots, for the health checks
+	adapters       []string
 	talkFact       def.ConversationFactory
 	speechToText   def.SpeechToText
 	textToSpeech   def.TextToSpeech
 	imageGenerator def.ImageGenerator
+	media          *media.Transcoder
 	config         ai.AIConfig
-	accessControl  util.AccessControl
-	loop           bool
+	accessControl  *acl.AccessControl
+	scheduler      *scheduler
+	quota          *quotaManager
+	accounting     *accounting.Store
+	router         *command.Router
+	pipeline       *pipeline.Pipeline
+	callbacks      map[string]callbackHandler
+	accessRequests *requestTracker
+	answers        *answerStore
+	inlineTyping   *debouncer
+	inlineResults  *inlineCache
+	overheard      *overheard
+	// chats that get transcripts instead of answers
+	transcribeOnly *chatSwitch
+	// the task queue of the host, set before the service starts
+	queue *taskqueue.Queue
+	// background work that saves state on the way out
+	stopped sync.WaitGroup
 }
 
-// func NewTgBotService(tgbotToken string, aicfg ai.AIConfig) def.BotService {
-func NewTgBotService(config util.Config, acl util.AccessControl) def.BotService {
-	aicfg := ai.AIConfig{
-		BotName:        config.BotName,
-		Model:          config.OpenAI.Model,
-		ApiKey:         config.OpenAI.APIKey,
-		ContextTimeout: config.OpenAI.ContextTimeout,
+// newBotTalkService sets up one bot of the config, the host runs its messages.
+// The adapters stop taking messages when ctx is done.
+func newBotTalkService(ctx context.Context, config util.Config, accessControl *acl.AccessControl) *BotTalkService {
+	aicfg := aiConfigOf(config)
+	transcoder := media.NewTranscoder(config.Media)
+
+	var bots []def.MessageBot
+	var adapters []string
+	if config.Telegram.BotToken != "" {
+		tgBot, err := im.NewTelegramBot(ctx, config.Telegram, transcoder)
+		if err != nil {
+			slog.Error("failed to start telegram bot", logging.KeyBot, instanceName(config), "err", err)
+		} else {
+			bots = append(bots, tgBot)
+			adapters = append(adapters, metrics.AdapterTelegram)
+		}
 	}
-	tgbotToken := config.Telegram.BotToken
-
-	tgBot, err := im.NewTelegramBot(tgbotToken)
-	if err != nil {
-		log.Error("failed to start telegram bot %v", err)
+	if config.Remote.Port != "" {
+		remoteBot, err := im.NewRemoteChatBot(ctx, config.Remote.Port)
+		if err != nil {
+			slog.Error("failed to start rpc bot", logging.KeyBot, instanceName(config), "err", err)
+		} else {
+			bots = append(bots, remoteBot)
+			adapters = append(adapters, metrics.AdapterRemote)
+		}
 	}
-	fmt.Println(tgBot)
 
-	remoteBot, err := im.NewRemoteChatBot("2952")
-	if err != nil {
-		log.Error("failed to start rpc bot %v", err)
+	loc := time.Local
+	if config.System.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(config.System.TimeZone); err != nil {
+			slog.Error("unknown time zone, use local time", "timeZone", config.System.TimeZone, "err", err)
+			loc = time.Local
+		}
 	}
 
-	return &BotTalkService{
-		bots:           []def.MessageBot{tgBot, remoteBot},
+	service := &BotTalkService{
+		name:           instanceName(config),
+		bots:           bots,
+		adapters:       adapters,
 		talkFact:       ai.NewTalkFactory(aicfg),
 		speechToText:   ai.NewSpeech2Text(aicfg.ApiKey),
 		textToSpeech:   ai.NewPyServiceTTS(),
 		imageGenerator: ai.NewImageGenerator(aicfg.ApiKey),
+		media:          transcoder,
 		config:         aicfg,
-		accessControl:  acl,
-		loop:           true,
+		appConfig:      config,
+		accessControl:  accessControl,
+	}
+	dataDir := util.GetDataDir(config)
+	if config.ACL != "" {
+		// a bot's own acl keeps its changes, audit log and invites in the bot's
+		// data dir, NewHost sets the dir of the shared acl
+		accessControl.SetDataDir(dataDir)
+	}
+	accessControl.SetWhitelist(config.System.WhitelistEnabled)
+	service.scheduler = newScheduler(
+		filepath.Join(dataDir, "jobs.json"),
+		loc,
+		service.fireJob,
+	)
+	service.accounting = accounting.NewStore(filepath.Join(dataDir, "usage.jsonl"), config.Pricing)
+	service.quota = newQuotaManager(
+		filepath.Join(dataDir, "quota.json"),
+		config,
+		accessControl.GroupOf,
+		loc,
+	)
+
+	service.router = command.NewRouter()
+	if err := service.router.Register(service.builtinCommands()...); err != nil {
+		slog.Error("failed to register builtin commands", "err", err)
 	}
+	for _, p := range command.Plugins() {
+		if err := service.router.Register(p.Commands()...); err != nil {
+			slog.Error("failed to register commands of plugin", "plugin", p.Name(), "err", err)
+			continue
+		}
+		slog.Info("plugin loaded", "plugin", p.Name())
+	}
+	service.pipeline = service.buildPipeline(config.Pipeline.Stages)
+	service.callbacks = map[string]callbackHandler{
+		callbackAccess: service.accessCallback,
+		callbackAnswer: service.answerCallback,
+	}
+	service.accessRequests = newRequestTracker(accessRequestCooldown)
+	service.answers = newAnswerStore()
+	service.inlineTyping = newDebouncer(inlineDebounce)
+	service.inlineResults = newInlineCache()
+	service.overheard = newOverheard()
+	service.transcribeOnly = newChatSwitch()
+
+	return service
 }
 
-func (s *BotTalkService) listenToAll() <-chan def.Message {
-	ch := make(chan def.Message, len(s.bots))
-	f := func(bot def.MessageBot) {
-		for m := range bot.GetMessages() {
-			ch <- m
-		}
+// instanceName names the bot in logs, the bot name for the top level bot
+func instanceName(config util.Config) string {
+	if config.Instance != "" {
+		return config.Instance
 	}
+	return config.BotName
+}
+
+// taskKey is the key of the chat in the task queue, the same chat with
+// two bots is two conversations
+func (s *BotTalkService) taskKey(cid def.ChatID) string {
+	return s.name + "/" + cid.String()
+}
+
+// SendMessage sends text to the chat from outside a reply context,
+// the chat is looked up in every bot this service runs.
+func (s *BotTalkService) SendMessage(cid def.ChatID, text string) error {
+	chat := s.findChat(cid)
+	if chat == nil {
+		return fmt.Errorf("chat %s not found", cid.String())
+	}
+	chat.SendMessage(text)
+	return nil
+}
+
+func (s *BotTalkService) findChat(cid def.ChatID) def.Chat {
 	for _, bot := range s.bots {
-		go f(bot)
+		if bot == nil {
+			continue
+		}
+		if chat := bot.GetChat(cid); chat != nil {
+			return chat
+		}
 	}
-	return ch
+	return nil
 }
 
-func (s *BotTalkService) Run() {
-	sigchnl := make(chan os.Signal, 1)
-	signal.Notify(sigchnl)
+// start runs the background work of the service until ctx is done, the host hands
+// in the messages. Work started by the service, like scheduled jobs, runs with work.
+func (s *BotTalkService) start(ctx, work context.Context) {
+	s.stopped.Add(1)
 	go func() {
-		for {
-			sig := <-sigchnl
-			s.handleSignal(sig)
-		}
+		defer s.stopped.Done()
+		s.quota.run(ctx)
 	}()
+	go s.scheduler.run(ctx, work)
+	go s.watchConfig(ctx)
+	s.listenToCallbacks(ctx)
+	s.listenToInlineQueries(ctx)
+	s.syncCommands()
+}
 
-	pool := gohelper.NewTaskPool[def.UserID](3, 1)
-	for m := range s.listenToAll() {
-		var uid def.UserID
-		if m == nil || m.GetUser() == nil || m.GetUser().GetID() == uid || m.GetChat() == nil {
-			log.Warn("received empty message, skip it")
-			if m == nil {
-				log.Debug("message is nil")
-				continue
-			}
-			log.Debug("message user is %v", m.GetUser())
-			log.Debug("message chat is %v", m.GetChat())
-			continue
-		}
+// wait blocks until the scheduled jobs being fired are done
+func (s *BotTalkService) wait() {
+	s.scheduler.wait()
+}
 
-		user := m.GetUser()
-		uid = user.GetID()
-		chat := m.GetChat()
-		cid := chat.GetID()
-		voice, voiceCleaner := m.GetVoice()
-		msgText := m.GetText()
-		msgID := m.GetID()
-
-		var allowed bool
-		allowed = s.accessControl.AllowUser(uid)
-		if !allowed {
-			allowed = s.accessControl.AllowChat(cid)
+// stop waits for the usage kept in memory to be saved and for the adapters to stop,
+// then closes the services. Call it once the tasks are drained, jobs and acl are
+// saved on every change.
+func (s *BotTalkService) stop() {
+	s.stopped.Wait()
+	for _, bot := range s.bots {
+		if waiter, ok := bot.(def.StopWaiter); ok {
+			waiter.WaitStopped()
+		}
+	}
+	// usage recorded by tasks that ran after the last flush
+	s.quota.flush()
+	if closer, ok := s.textToSpeech.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Warn("failed to close text to speech", "err", err)
 		}
+	}
+	slog.Info("bot stopped", logging.KeyBot, s.name)
+}
+
+// task returns the handling of one message for the task queue
+func (s *BotTalkService) task(message def.Message) taskqueue.Task {
+	return func(work context.Context) {
+		defer func() { _ = recover() }()
+
+		defer discardVoice(message)
 
-		task := func() {
-			defer func() { _ = recover() }()
-
-			if voice != "" {
-				defer voiceCleaner()
-			}
-
-			memberCnt := chat.GetMemberCount()
-			botUsername := chat.GetSelf().GetUserName()
-
-			var text string
-			var err error
-
-			if memberCnt <= 2 && !allowed {
-				chat.ReplyMessage(
-					"Sorry, this AI assistant is not allowed in this conversation."+
-						" Please contact the administrator for access.",
-					msgID,
-				)
-				log.Info(
-					"access denied for user '%s' in chat '%s', message text: %s",
-					uid.String(),
-					cid.String(),
-					msgText,
-				)
-				return
-			}
-
-			if voice != "" {
-				// get text from voice
-				var mp3 string
-				var cleaner def.CleanFunc
-				if strings.EqualFold(filepath.Ext(voice), ".oga") {
-					mp3, cleaner = util.ConvertToMp3(voice)
-					defer cleaner()
-				}
-				text, err = s.speechToText.Convert(mp3)
-				if err != nil {
-					log.Warn("speech to text failed, %v", err)
-				}
-			} else if msgText != "" {
-				text = msgText
-			}
-
-			if size, desc := s.isDrawCommand(text); size != "" {
-				// draw image
-				log.Debug(
-					"received image request from %s, id %d: %s",
-					user.GetUserName(),
-					uid,
-					text,
-				)
-				if !allowed {
-					chat.ReplyMessage(
-						"Sorry, AI assistant is not allow to draw in this conversation."+
-							" Please contact the administrator for access.",
-						msgID,
-					)
-					log.Info("access denied for user '%s' in chat '%s'", uid.String(), cid.String())
-					return
-				}
-				img, cleaner, err := s.imageGenerator.Generate(desc, size)
-				if err != nil {
-					chat.ReplyMessage(err.Error(), msgID)
-					return
-				}
-				defer cleaner()
-				chat.ReplyImage(img, msgID)
-			} else {
-				if memberCnt > 2 && !s.isMentioned(text, botUsername) {
-					return
-				}
-
-				if !allowed {
-					chat.ReplyMessage(
-						"Sorry, this AI assistant is not allowed in this conversation."+
-							" Please contact the administrator for access.",
-						msgID,
-					)
-					log.Info("access denied for user '%s' in chat '%s'", uid.String(), cid.String())
-					return
-				}
-
-				log.Info("received question from %s, id %s: %s", user.GetUserName(), uid.String(), text)
-				talk := s.talkFact.GetTalk(cid)
-				answer := talk.Ask(text)
-
-				if voice == "" {
-					chat.ReplyMessage(answer, msgID)
-				} else {
-					chat.QuoteMessage(answer, msgID, "Transcription:\n"+text)
-					if vf, cleaner, err := s.textToSpeech.Convert(answer); err != nil {
-						log.Error(`convert text "%s" to speech failed, %v`, text, err)
-					} else {
-						defer cleaner()
-						chat.ReplyVoice(vf, msgID)
-						log.Info("voice replied to %s", user.GetUserName())
-					}
-				}
-				log.Info("replied to %s", user.GetUserName())
-			}
+		reqId := logging.NewID()
+		if c, ok := message.(def.Correlated); ok {
+			reqId = c.GetCorrelationID()
 		}
-		pool.Run(uid, task)
-		if !s.loop {
-			log.Info("stop running loop")
-			time.Sleep(time.Duration(time.Second * 3))
-			break
+		chat := message.GetChat()
+		if t, ok := message.(def.Traced); ok {
+			work = tracing.Continue(work, t.GetTraceContext())
 		}
+		work, span := tracing.Start(work, "handle message",
+			tracing.KeyRequest.String(reqId),
+			tracing.KeyBot.String(s.name),
+			tracing.KeyUser.String(message.GetUser().GetID().String()),
+			tracing.KeyChat.String(chat.GetID().String()),
+		)
+		defer span.End()
+
+		logger := slog.With(
+			logging.KeyRequest, reqId,
+			logging.KeyBot, s.name,
+			logging.KeyUser, message.GetUser().GetID().String(),
+			logging.KeyChat, chat.GetID().String(),
+		)
+		if traceId := tracing.TraceID(work); traceId != "" {
+			logger = logger.With(logging.KeyTrace, traceId)
+		}
+		ctx := &pipeline.Context{
+			Ctx:         logging.WithLogger(work, logger),
+			Service:     s,
+			Message:     message,
+			User:        message.GetUser(),
+			Chat:        tracing.Chat(work, chat),
+			Text:        message.GetText(),
+			Recording:   hasRecording(message),
+			IsGroup:     chat.GetMemberCount() > 2,
+			BotUsername: chat.GetSelf().GetUserName(),
+			Allow:       func(def.Permission) bool { return false },
+		}
+		s.pipeline.Run(ctx)
+	}
+}
+
+// showAction shows the action in the chat while a long step runs,
+// call the returned func when the step is done
+func showAction(chat def.Chat, action def.ChatAction) func() {
+	if ac, ok := chat.(def.ActionChat); ok {
+		return ac.StartAction(action)
+	}
+	return func() {}
+}
+
+// isAddressed tells if a message is for the bot, it mentions the bot or replies to it
+func (s *BotTalkService) isAddressed(m def.Message, text string, self def.User) bool {
+	if r := m.GetReplyTo(); r != nil && r.User != nil && r.User.GetID() == self.GetID() {
+		return true
 	}
+	return s.isMentioned(text, self.GetUserName())
 }
 
 func (s *BotTalkService) isMentioned(text, botUsername string) bool {
@@ -245,7 +317,7 @@ func (s *BotTalkService) isMentioned(text, botUsername string) bool {
 		head = tokens
 	}
 
-	if ssContain(head, s.config.BotName, true) {
+	if ssContain(head, s.aiConfig().BotName, true) {
 		return true
 	}
 
@@ -282,37 +354,3 @@ func spliteByPunctuation(ss []string) []string {
 
 	return ss
 }
-
-func (s *BotTalkService) handleSignal(signal os.Signal) {
-	switch signal {
-	case syscall.SIGQUIT:
-		s.loop = false
-		log.Info("signal SIGQUIT received")
-	default:
-	}
-}
-
-func (s *BotTalkService) isDrawCommand(text string) (string, string) {
-	pat := regexp.MustCompile(`^/(?P<drawcmd>(draw|drawbig|drawsmall))\s+(?P<desc>.*)`)
-	match := pat.FindStringSubmatch(text)
-
-	result := make(map[string]string)
-	for i, name := range pat.SubexpNames() {
-		if i != 0 && name != "" && len(match) > i {
-			result[name] = match[i]
-		}
-	}
-
-	cmd, _ := result["drawcmd"]
-	desc, _ := result["desc"]
-	switch cmd {
-	case "draw":
-		return "m", desc
-	case "drawbig":
-		return "b", desc
-	case "drawsmall":
-		return "s", desc
-	default:
-		return "", ""
-	}
-}
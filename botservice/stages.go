@@ -0,0 +1,343 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"chloe/accounting"
+	"chloe/ai"
+	"chloe/command"
+	"chloe/def"
+	"chloe/logging"
+	"chloe/media"
+	"chloe/pipeline"
+)
+
+const (
+	stageAuth          = "auth"
+	stageRateLimit     = "ratelimit"
+	stageTranscription = "transcription"
+	stageMention       = "mention"
+	stageCommand       = "command"
+	stageConversation  = "conversation"
+)
+
+const notAllowedText = "Sorry, this AI assistant is not allowed in this conversation." +
+	" Please contact the administrator for access."
+
+const (
+	// quoted text given to the model along with a reply, longer quotes are cut
+	replyQuoteLimit = 2000
+	replyContext    = "In reply to %s:\n\"\"\"\n%s\n\"\"\"\n\n%s"
+)
+
+var defaultStages = []string{
+	stageAuth,
+	stageRateLimit,
+	stageTranscription,
+	stageMention,
+	stageCommand,
+	stageConversation,
+}
+
+// buildPipeline chains the stages by name, builtin stages first and then
+// the ones registered by other packages
+func (s *BotTalkService) buildPipeline(names []string) *pipeline.Pipeline {
+	if len(names) == 0 {
+		names = defaultStages
+	}
+
+	builtin := map[string]pipeline.Stage{
+		stageAuth:          pipeline.NewStage(stageAuth, s.authStage),
+		stageRateLimit:     pipeline.NewStage(stageRateLimit, s.rateLimitStage),
+		stageTranscription: pipeline.NewStage(stageTranscription, s.transcriptionStage),
+		stageMention:       pipeline.NewStage(stageMention, s.mentionStage),
+		stageCommand:       pipeline.NewStage(stageCommand, s.commandStage),
+		stageConversation:  pipeline.NewStage(stageConversation, s.conversationStage),
+	}
+
+	var stages []pipeline.Stage
+	for _, name := range names {
+		stage, exists := builtin[name]
+		if !exists {
+			stage = pipeline.LookupStage(name)
+		}
+		if stage == nil {
+			slog.Error("unknown pipeline stage, skipped", "stage", name)
+			continue
+		}
+		stages = append(stages, stage)
+	}
+
+	p := pipeline.New(stages...)
+	slog.Info("message pipeline built", "stages", strings.Join(p.Stages(), " -> "))
+	return p
+}
+
+// authStage decides what the sender may do. In private chats a sender without access
+// is turned away early, before any cost on transcription; only open commands like /help pass.
+func (s *BotTalkService) authStage(ctx *pipeline.Context, next pipeline.Next) {
+	uid := ctx.User.GetID()
+	cid := ctx.Chat.GetID()
+
+	ctx.Allowed = s.accessControl.HasPermission(uid, cid, def.PermChat)
+	ctx.Allow = func(perm def.Permission) bool {
+		return s.accessControl.HasPermission(uid, cid, perm)
+	}
+
+	if !ctx.IsGroup && !ctx.Allowed {
+		if cmd, _, _ := s.router.Find(ctx.Text, ctx.BotUsername); cmd == nil || cmd.Permission != "" {
+			s.rejectAccess(ctx)
+			logging.FromContext(ctx.Ctx).Info("access denied", logging.Text("text", ctx.Text))
+			return
+		}
+	}
+	next()
+}
+
+// rateLimitStage counts the message against rate limits and quotas. Group text and
+// recordings the bot leaves alone cost nothing and pass uncounted, the mention stage
+// drops them later.
+func (s *BotTalkService) rateLimitStage(ctx *pipeline.Context, next pipeline.Next) {
+	recording := ctx.Recording && !s.skipsRecording(ctx)
+	if ctx.IsGroup && !recording && !s.isAddressed(ctx.Message, ctx.Text, ctx.Chat.GetSelf()) {
+		if cmd, _, _ := s.router.Find(ctx.Text, ctx.BotUsername); cmd == nil {
+			next()
+			return
+		}
+	}
+
+	uid := ctx.User.GetID()
+	cid := ctx.Chat.GetID()
+	err := s.quota.take(uid, cid)
+	if err == nil && recording {
+		err = s.quota.check(uid, cid, quotaAudio)
+	}
+	if err != nil {
+		logging.FromContext(ctx.Ctx).Info("limited", "err", err)
+		// a voice message in a group may not be for the bot, don't bother the group
+		if !ctx.IsGroup || !ctx.Recording || !isVoiceNote(ctx.Message) {
+			ctx.Reply(quotaReply(err))
+		}
+		return
+	}
+	next()
+}
+
+// transcriptionStage turns the recording of a message into its text. In groups only
+// voice messages may speak to the bot, other recordings are left alone unless they
+// are addressed to it or the chat is in transcription mode.
+func (s *BotTalkService) transcriptionStage(ctx *pipeline.Context, next pipeline.Next) {
+	if !ctx.Recording {
+		next()
+		return
+	}
+	if s.skipsRecording(ctx) {
+		// the caption goes on like a text message, the recording is never downloaded
+		ctx.Recording = false
+		next()
+		return
+	}
+	// a voice message in a group may not be for the bot, it stays quiet about failures
+	quiet := ctx.IsGroup && isVoiceNote(ctx.Message)
+	if !ctx.Allow(def.PermVoice) {
+		if !quiet {
+			ctx.Reply("Sorry, you are not allowed to send voice messages to this AI assistant.")
+		}
+		logging.FromContext(ctx.Ctx).Info("voice denied")
+		return
+	}
+	voice, _, err := ctx.Message.GetVoice()
+	if err != nil {
+		logging.FromContext(ctx.Ctx).Info("voice not downloaded", "err", err)
+		if !quiet {
+			ctx.Reply(mediaErrorText(err))
+		}
+		return
+	}
+	ctx.Voice = voice
+
+	if !quiet {
+		stop := showAction(ctx.Chat, def.ActionTyping)
+		defer stop()
+	}
+	text, info, err := s.transcribe(ctx.Ctx, ctx.Voice)
+	if errors.Is(err, errSpeechToText) {
+		logging.FromContext(ctx.Ctx).Warn("speech to text failed", "err", err)
+		ctx.Reply("Sorry, I could not understand the voice message.")
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx.Ctx).Warn("voice not transcoded", "err", err)
+		if !quiet {
+			ctx.Reply(mediaErrorText(err))
+		}
+		return
+	}
+	s.account(accounting.Record{
+		UserID:       ctx.User.GetID(),
+		ChatID:       ctx.Chat.GetID(),
+		Kind:         accounting.KindTranscription,
+		Model:        ai.SpeechModel,
+		AudioSeconds: info.Duration.Seconds(),
+	})
+	if s.transcribeOnly.get(ctx.Chat.GetID()) {
+		s.replyTranscript(ctx, text)
+		return
+	}
+	if caption := strings.TrimSpace(ctx.Text); caption != "" {
+		// the caption may address the bot or ask about the recording
+		text = caption + "\n\n" + text
+	}
+	ctx.Text = text
+	next()
+}
+
+// skipsRecording tells if the recording of a group message is left alone, it is
+// audio or a video neither addressed to the bot nor in a chat in transcription mode
+func (s *BotTalkService) skipsRecording(ctx *pipeline.Context) bool {
+	return ctx.IsGroup && !isVoiceNote(ctx.Message) &&
+		!s.isAddressed(ctx.Message, ctx.Text, ctx.Chat.GetSelf()) &&
+		!s.transcribeOnly.get(ctx.Chat.GetID())
+}
+
+// isVoiceNote tells if the recording of the message is a voice message, messages
+// that can't tell are taken as one
+func isVoiceNote(m def.Message) bool {
+	r, ok := m.(def.Recorded)
+	return !ok || r.IsVoiceNote()
+}
+
+// hasRecording tells if the message has a recording, without downloading it
+func hasRecording(m def.Message) bool {
+	if r, ok := m.(def.Recorded); ok {
+		return r.HasRecording()
+	}
+	file, _, err := m.GetVoice()
+	return file != "" || err != nil
+}
+
+// discardVoice removes the recording of the message if it was downloaded
+func discardVoice(m def.Message) {
+	if r, ok := m.(def.Recorded); ok {
+		r.Discard()
+		return
+	}
+	if file, cleaner, _ := m.GetVoice(); file != "" {
+		cleaner()
+	}
+}
+
+// mediaErrorText tells the user why their audio can't be used
+func mediaErrorText(err error) string {
+	switch {
+	case errors.Is(err, media.ErrTooLarge):
+		return "Sorry, the file is too large for me."
+	case errors.Is(err, media.ErrTooLong):
+		return "Sorry, the recording is too long for me."
+	case errors.Is(err, media.ErrNoAudio):
+		return "Sorry, there is no sound in it."
+	default:
+		return "Sorry, I could not read the recording."
+	}
+}
+
+// mentionStage drops group messages not addressed to the bot, commands and replies
+// to the bot always pass. Passive groups keep the dropped ones as background.
+func (s *BotTalkService) mentionStage(ctx *pipeline.Context, next pipeline.Next) {
+	if ctx.IsGroup && !s.isAddressed(ctx.Message, ctx.Text, ctx.Chat.GetSelf()) {
+		if cmd, _, _ := s.router.Find(ctx.Text, ctx.BotUsername); cmd == nil {
+			if ctx.Allowed {
+				s.overhear(ctx.Chat, ctx.User, ctx.Text)
+			}
+			return
+		}
+	}
+	next()
+}
+
+func (s *BotTalkService) commandStage(ctx *pipeline.Context, next pipeline.Next) {
+	cmdCtx := &command.Context{
+		Ctx:     ctx.Ctx,
+		Service: s,
+		Message: ctx.Message,
+		User:    ctx.User,
+		Chat:    ctx.Chat,
+		Text:    ctx.Text,
+		Allow:   ctx.Allow,
+	}
+	if s.router.Dispatch(cmdCtx, ctx.BotUsername) {
+		return
+	}
+	next()
+}
+
+// withReplyContext puts the text the question replies to before it, so the model
+// knows what "this" or "that" is about
+func withReplyContext(question string, replyTo *def.ReplyTo, self def.User) string {
+	if replyTo == nil || strings.TrimSpace(replyTo.Text) == "" {
+		return question
+	}
+	quote := []rune(replyTo.Text)
+	if len(quote) > replyQuoteLimit {
+		quote = append(quote[:replyQuoteLimit], '…')
+	}
+	author := "a message"
+	if replyTo.User != nil {
+		if replyTo.User.GetID() == self.GetID() {
+			author = "your message"
+		} else if name := replyTo.User.GetFirstName(); name != "" {
+			author = "a message of " + name
+		}
+	}
+	return fmt.Sprintf(replyContext, author, string(quote), question)
+}
+
+func (s *BotTalkService) conversationStage(ctx *pipeline.Context, next pipeline.Next) {
+	uid := ctx.User.GetID()
+	cid := ctx.Chat.GetID()
+	msgID := ctx.Message.GetID()
+
+	if !ctx.Allowed {
+		ctx.Reply(notAllowedText)
+		logging.FromContext(ctx.Ctx).Info("access denied")
+		return
+	}
+
+	if err := s.quota.check(uid, cid, quotaTokens); err != nil {
+		ctx.Reply(quotaReply(err))
+		return
+	}
+
+	logger := logging.FromContext(ctx.Ctx)
+	logger.Info("question received", "userName", ctx.User.GetUserName(), logging.Text("text", ctx.Text))
+	question := withReplyContext(ctx.Text, ctx.Message.GetReplyTo(), ctx.Chat.GetSelf())
+	stopTyping := showAction(ctx.Chat, def.ActionTyping)
+	thread := s.threadOf(ctx.Chat, uid)
+	answer, usage := s.ask(ctx.Ctx, ctx.Chat, thread, ctx.User, question)
+	stopTyping()
+	s.accountChat(uid, cid, usage)
+
+	if ctx.Voice == "" || !ctx.Allow(def.PermTTS) {
+		s.replyAnswer(ctx.Chat, msgID, thread, ctx.User, question, answer)
+	} else {
+		ctx.Chat.QuoteMessage(answer, msgID, "Transcription:\n"+ctx.Text)
+		stopRecording := showAction(ctx.Chat, def.ActionRecordVoice)
+		defer stopRecording()
+		if vf, cleaner, err := s.textToSpeech.Convert(ctx.Ctx, answer); err != nil {
+			logger.Error("text to speech failed", logging.Text("text", answer), "err", err)
+		} else {
+			defer cleaner()
+			ctx.Chat.ReplyVoice(vf, msgID)
+			logger.Info("voice replied")
+		}
+	}
+	logger.Info("replied", logging.Text("answer", answer))
+	next()
+}
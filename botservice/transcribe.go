@@ -0,0 +1,157 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"chloe/ai"
+	"chloe/command"
+	"chloe/def"
+	"chloe/logging"
+	"chloe/media"
+	"chloe/pipeline"
+)
+
+const (
+	// long recordings are cut into parts of this length and transcribed at the same time
+	transcribePartLength = 5 * time.Minute
+	transcribeParallel   = 4
+	// longer transcripts are sent as a text file
+	transcriptFileLength = 3500
+)
+
+// errSpeechToText tells a failed transcription from audio that could not be read
+var errSpeechToText = errors.New("speech to text failed")
+
+// chatSwitch is a setting that is on or off by chat
+type chatSwitch struct {
+	guard sync.Mutex
+	on    map[def.ChatID]bool
+}
+
+func newChatSwitch() *chatSwitch {
+	return &chatSwitch{
+		on: make(map[def.ChatID]bool),
+	}
+}
+
+func (cs *chatSwitch) get(cid def.ChatID) bool {
+	cs.guard.Lock()
+	defer cs.guard.Unlock()
+
+	return cs.on[cid]
+}
+
+func (cs *chatSwitch) set(cid def.ChatID, on bool) {
+	cs.guard.Lock()
+	defer cs.guard.Unlock()
+
+	if on {
+		cs.on[cid] = true
+	} else {
+		delete(cs.on, cid)
+	}
+}
+
+// transcribe extracts the audio of the file and transcribes it, long recordings
+// in parts at the same time. info is what the file was probed as.
+func (s *BotTalkService) transcribe(ctx context.Context, file string) (string, media.Info, error) {
+	mp3, info, cleaner, err := s.media.Transcode(ctx, file, media.MP3)
+	if err != nil {
+		return "", info, err
+	}
+	defer cleaner()
+
+	parts, partsCleaner, err := s.media.Split(ctx, mp3, ai.SpeechMaxBytes, transcribePartLength)
+	if err != nil {
+		return "", info, err
+	}
+	defer partsCleaner()
+	if len(parts) > 1 {
+		logging.FromContext(ctx).Debug("recording split", "parts", len(parts), "seconds", info.Duration.Seconds())
+	}
+
+	stt := s.speech()
+	texts := make([]string, len(parts))
+	errs := make([]error, len(parts))
+	slots := make(chan struct{}, transcribeParallel)
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			texts[i], errs[i] = stt.Convert(ctx, part)
+		}(i, part)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return "", info, fmt.Errorf("%w, %v", errSpeechToText, err)
+		}
+	}
+	var stitched []string
+	for _, text := range texts {
+		if text = strings.TrimSpace(text); text != "" {
+			stitched = append(stitched, text)
+		}
+	}
+	return strings.Join(stitched, " "), info, nil
+}
+
+// replyTranscript replies the transcript as it is, as a text file if it is long
+func (s *BotTalkService) replyTranscript(ctx *pipeline.Context, text string) {
+	if strings.TrimSpace(text) == "" {
+		ctx.Reply("I could not hear any words.")
+		return
+	}
+	if len([]rune(text)) <= transcriptFileLength {
+		ctx.Reply(text)
+		return
+	}
+
+	f, err := os.CreateTemp("", "transcript-*.txt")
+	if err != nil {
+		logging.FromContext(ctx.Ctx).Error("failed to create transcript file", "err", err)
+		ctx.Reply(text)
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(text)
+	f.Close()
+	if err != nil {
+		logging.FromContext(ctx.Ctx).Error("failed to write transcript file", "path", f.Name(), "err", err)
+		ctx.Reply(text)
+		return
+	}
+	ctx.Chat.ReplyFile(f.Name(), ctx.Message.GetID())
+}
+
+func (s *BotTalkService) transcribeCommand(ctx *command.Context) {
+	cid := ctx.Chat.GetID()
+	on := !s.transcribeOnly.get(cid)
+	switch strings.ToLower(ctx.Arg(0)) {
+	case "on":
+		on = true
+	case "off":
+		on = false
+	}
+	s.transcribeOnly.set(cid, on)
+
+	if on {
+		ctx.Reply("Transcription mode is on. Send voice messages, audio or videos and I will reply with what is said, /transcribe again to talk.")
+	} else {
+		ctx.Reply("Transcription mode is off, I will answer voice messages again.")
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package botservice
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"chloe/accounting"
+	"chloe/command"
+	"chloe/def"
+	"chloe/logging"
+	"chloe/metrics"
+	"chloe/util"
+)
+
+const (
+	periodDay   = "day"
+	periodMonth = "month"
+)
+
+func (s *BotTalkService) usageCommands() []*command.Command {
+	return []*command.Command{
+		{
+			Name:       "usage",
+			Help:       "show your usage and its cost",
+			Permission: def.PermChat,
+			Handler:    s.usageCommand,
+		},
+		{
+			Name:       "report",
+			Args:       "[day|month] [date] [csv]",
+			Help:       "usage report of all chats, csv exports the records",
+			Permission: def.PermAdmin,
+			Handler:    s.reportCommand,
+		},
+	}
+}
+
+// account records what a request used, for the quotas, the cost report and the metrics
+func (s *BotTalkService) account(rec accounting.Record) {
+	rec = s.accounting.Record(rec)
+	metrics.TokensUsed(rec.Model, rec.PromptTokens, rec.CompletionTokens)
+	if rec.Images > 0 {
+		metrics.ImagesGenerated(rec.ImageSize, rec.Images)
+	}
+	if rec.AudioSeconds > 0 {
+		metrics.AudioTranscribed(rec.AudioSeconds)
+	}
+	s.quota.record(rec.UserID, rec.ChatID, util.QuotaAmount{
+		Tokens:       rec.PromptTokens + rec.CompletionTokens,
+		Images:       rec.Images,
+		AudioSeconds: rec.AudioSeconds,
+	})
+}
+
+func (s *BotTalkService) usageCommand(ctx *command.Context) {
+	uid := ctx.User.GetID()
+	now := time.Now().In(s.scheduler.loc)
+	dayFrom, dayTo, _ := reportRange(periodDay, "", now)
+	monthFrom, monthTo, _ := reportRange(periodMonth, "", now)
+
+	records, err := s.accounting.Query(monthFrom, monthTo, func(rec accounting.Record) bool {
+		return rec.UserID == uid
+	})
+	if err != nil {
+		logging.FromContext(ctx.Ctx).Error("failed to query usage", "err", err)
+		ctx.Reply("Sorry, the usage is not available now.")
+		return
+	}
+
+	var today, month accounting.Summary
+	for _, rec := range records {
+		month.Add(rec)
+		if !rec.Time.Before(dayFrom) && rec.Time.Before(dayTo) {
+			today.Add(rec)
+		}
+	}
+	currency := s.accounting.Currency()
+	ctx.Reply(fmt.Sprintf(
+		"Your usage today: %s\nYour usage this month: %s",
+		formatSummary(&today, currency),
+		formatSummary(&month, currency),
+	))
+}
+
+func (s *BotTalkService) reportCommand(ctx *command.Context) {
+	period, date, exportCSV := periodMonth, "", false
+	for _, arg := range ctx.Args {
+		switch strings.ToLower(arg) {
+		case "day", "daily", "today":
+			period = periodDay
+		case "month", "monthly":
+			period = periodMonth
+		case "csv":
+			exportCSV = true
+		default:
+			date = arg
+		}
+	}
+
+	from, to, err := reportRange(period, date, time.Now().In(s.scheduler.loc))
+	if err != nil {
+		ctx.Reply(err.Error())
+		return
+	}
+	records, err := s.accounting.Query(from, to, nil)
+	if err != nil {
+		logging.FromContext(ctx.Ctx).Error("failed to query usage", "err", err)
+		ctx.Reply("Sorry, the usage is not available now.")
+		return
+	}
+
+	title := from.Format("2006-01")
+	if period == periodDay {
+		title = from.Format("2006-01-02")
+	}
+
+	if exportCSV {
+		f, err := os.CreateTemp("", "usage-"+title+"-*.csv")
+		if err != nil {
+			logging.FromContext(ctx.Ctx).Error("failed to create csv file", "err", err)
+			ctx.Reply("Sorry, the report can not be exported now.")
+			return
+		}
+		defer os.Remove(f.Name())
+		err = accounting.WriteCSV(f, records)
+		f.Close()
+		if err != nil {
+			logging.FromContext(ctx.Ctx).Error("failed to write csv file", "path", f.Name(), "err", err)
+			ctx.Reply("Sorry, the report can not be exported now.")
+			return
+		}
+		ctx.Chat.ReplyFile(f.Name(), ctx.Message.GetID())
+		return
+	}
+
+	currency := s.accounting.Currency()
+	var total accounting.Summary
+	for _, rec := range records {
+		total.Add(rec)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Usage report for %s\n", title)
+	fmt.Fprintf(&sb, "Total: %s\n", formatSummary(&total, currency))
+
+	sb.WriteString("\nBy chat:\n")
+	byChat := accounting.Summarize(records, func(rec accounting.Record) string {
+		return rec.ChatID.String()
+	})
+	for _, cid := range accounting.SortedKeys(byChat) {
+		fmt.Fprintf(&sb, "%s: %s\n", cid, formatSummary(byChat[cid], currency))
+	}
+
+	sb.WriteString("\nBy model:\n")
+	byModel := accounting.Summarize(records, func(rec accounting.Record) string {
+		return rec.Model
+	})
+	for _, model := range accounting.SortedKeys(byModel) {
+		fmt.Fprintf(&sb, "%s: %s\n", model, formatSummary(byModel[model], currency))
+	}
+
+	ctx.Reply(sb.String())
+}
+
+// reportRange returns the day or month that contains date, or now if date is empty
+func reportRange(period, date string, now time.Time) (time.Time, time.Time, error) {
+	loc := now.Location()
+	if period == periodDay {
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		if date != "" {
+			var err error
+			if day, err = time.ParseInLocation("2006-01-02", date, loc); err != nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("invalid date '%s', use 2006-01-02", date)
+			}
+		}
+		return day, day.AddDate(0, 0, 1), nil
+	}
+
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	if date != "" {
+		var err error
+		if month, err = time.ParseInLocation("2006-01", date, loc); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid month '%s', use 2006-01", date)
+		}
+	}
+	return month, month.AddDate(0, 1, 0), nil
+}
+
+func formatSummary(sum *accounting.Summary, currency string) string {
+	return fmt.Sprintf(
+		"%d requests, %d tokens, %d images, %.0fs audio, cost %.4f %s",
+		sum.Requests,
+		sum.PromptTokens+sum.CompletionTokens,
+		sum.Images,
+		sum.AudioSeconds,
+		sum.Cost,
+		currency,
+	)
+}
@@ -0,0 +1,87 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package command
+
+import (
+	"context"
+	"strings"
+
+	"chloe/def"
+)
+
+type Handler func(ctx *Context)
+
+type Command struct {
+	// Name is what users type after the slash, lower case letters, digits and underscores
+	Name    string
+	Aliases []string
+	// Args describes the arguments in the usage line, like "<size> <description>"
+	Args string
+	Help string
+	// Permission required to run the command, empty means everyone can run it
+	Permission def.Permission
+	// MinArgs is the least number of arguments, the usage is replied if fewer are given
+	MinArgs int
+	// Hidden commands are not listed in /help and not synced to the IM
+	Hidden  bool
+	Handler Handler
+}
+
+func (cmd *Command) Usage() string {
+	usage := "/" + cmd.Name
+	if cmd.Args != "" {
+		usage += " " + cmd.Args
+	}
+	return usage
+}
+
+// Context is what a handler gets to serve one invocation of a command
+type Context struct {
+	// Ctx is canceled when the bot shuts down and can't wait for the command any longer
+	Ctx     context.Context
+	Service def.MessageSender
+	Message def.Message
+	User    def.User
+	Chat    def.Chat
+	Command *Command
+	// Name is the name the command was invoked with, it can be one of the aliases
+	Name string
+	// Text is the whole message text, which is the transcription for voice messages
+	Text    string
+	Args    []string
+	RawArgs string
+	// Allow tells if the sender of the message has the permission
+	Allow func(def.Permission) bool
+}
+
+func (ctx *Context) Reply(text string) {
+	ctx.Chat.ReplyMessage(text, ctx.Message.GetID())
+}
+
+func (ctx *Context) ReplyUsage() {
+	ctx.Reply("Usage: " + ctx.Command.Usage())
+}
+
+// Arg returns the i-th argument, or an empty string if there are not that many
+func (ctx *Context) Arg(i int) string {
+	if i < len(ctx.Args) {
+		return ctx.Args[i]
+	}
+	return ""
+}
+
+// ArgsFrom returns the raw text starting from the i-th argument with its spacing kept
+func (ctx *Context) ArgsFrom(i int) string {
+	rest := ctx.RawArgs
+	for ; i > 0; i-- {
+		rest = strings.TrimLeft(rest, " \t\n")
+		if idx := strings.IndexAny(rest, " \t\n"); idx >= 0 {
+			rest = rest[idx+1:]
+		} else {
+			rest = ""
+		}
+	}
+	return strings.TrimSpace(rest)
+}
@@ -0,0 +1,35 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package command
+
+import (
+	"sync"
+)
+
+// Plugin is a set of commands that lives in its own package. A plugin package
+// registers itself in init() and is enabled by importing it into main:
+//
+//	import _ "chloe/plugins/myplugin"
+type Plugin interface {
+	Name() string
+	Commands() []*Command
+}
+
+var pluginGuard sync.Mutex
+var plugins []Plugin
+
+func RegisterPlugin(p Plugin) {
+	pluginGuard.Lock()
+	defer pluginGuard.Unlock()
+
+	plugins = append(plugins, p)
+}
+
+func Plugins() []Plugin {
+	pluginGuard.Lock()
+	defer pluginGuard.Unlock()
+
+	return append([]Plugin(nil), plugins...)
+}
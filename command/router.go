@@ -0,0 +1,154 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package command
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"chloe/def"
+	"chloe/logging"
+)
+
+// same rule telegram uses for bot command names
+var namePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+type Router struct {
+	guard    sync.RWMutex
+	commands []*Command
+	names    map[string]*Command
+}
+
+func NewRouter() *Router {
+	return &Router{
+		names: make(map[string]*Command),
+	}
+}
+
+// Register adds commands to the router, a command whose name or alias is taken is rejected
+func (r *Router) Register(cmds ...*Command) error {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	for _, cmd := range cmds {
+		if cmd.Handler == nil {
+			return fmt.Errorf("command /%s has no handler", cmd.Name)
+		}
+		names := append([]string{cmd.Name}, cmd.Aliases...)
+		for _, name := range names {
+			if !namePattern.MatchString(name) {
+				return fmt.Errorf("invalid command name '%s'", name)
+			}
+			if _, exists := r.names[name]; exists {
+				return fmt.Errorf("command /%s is already registered", name)
+			}
+		}
+		for _, name := range names {
+			r.names[name] = cmd
+		}
+		r.commands = append(r.commands, cmd)
+	}
+	return nil
+}
+
+// Find looks up the command in text. Commands addressed to another bot
+// like /draw@otherbot are not found.
+func (r *Router) Find(text, botUsername string) (*Command, string, string) {
+	text = strings.TrimLeft(text, " \t\n")
+	if !strings.HasPrefix(text, "/") {
+		return nil, "", ""
+	}
+
+	head, rawArgs := text[1:], ""
+	if i := strings.IndexAny(head, " \t\n"); i >= 0 {
+		head, rawArgs = head[:i], head[i+1:]
+	}
+	name, target, addressed := strings.Cut(head, "@")
+	if addressed && !strings.EqualFold(target, botUsername) {
+		return nil, "", ""
+	}
+	name = strings.ToLower(name)
+
+	r.guard.RLock()
+	defer r.guard.RUnlock()
+
+	cmd, exists := r.names[name]
+	if !exists {
+		return nil, "", ""
+	}
+	return cmd, name, rawArgs
+}
+
+// Dispatch runs the command in ctx.Text, it returns false if the text is not a known command.
+// Permission and argument count are checked before the handler runs.
+func (r *Router) Dispatch(ctx *Context, botUsername string) bool {
+	cmd, name, rawArgs := r.Find(ctx.Text, botUsername)
+	if cmd == nil {
+		return false
+	}
+	ctx.Command = cmd
+	ctx.Name = name
+	ctx.RawArgs = rawArgs
+	ctx.Args = strings.Fields(rawArgs)
+
+	logger := logging.FromContext(ctx.Ctx).With("command", name)
+	if cmd.Permission != "" && (ctx.Allow == nil || !ctx.Allow(cmd.Permission)) {
+		ctx.Reply(fmt.Sprintf(
+			"Sorry, you are not allowed to use /%s in this conversation."+
+				" Please contact the administrator for access.",
+			name,
+		))
+		logger.Info("command denied")
+		return true
+	}
+	if len(ctx.Args) < cmd.MinArgs {
+		ctx.ReplyUsage()
+		return true
+	}
+
+	logger.Info("command runs")
+	cmd.Handler(ctx)
+	return true
+}
+
+// Commands returns the visible commands ordered by name
+func (r *Router) Commands() []*Command {
+	r.guard.RLock()
+	defer r.guard.RUnlock()
+
+	var cmds []*Command
+	for _, cmd := range r.commands {
+		if !cmd.Hidden {
+			cmds = append(cmds, cmd)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].Name < cmds[j].Name
+	})
+	return cmds
+}
+
+// Help lists the visible commands the user is allowed to run
+func (r *Router) Help(allow func(def.Permission) bool) string {
+	var sb strings.Builder
+	sb.WriteString("Available commands:\n")
+	for _, cmd := range r.Commands() {
+		if cmd.Permission != "" && (allow == nil || !allow(cmd.Permission)) {
+			continue
+		}
+		sb.WriteString(cmd.Usage())
+		if cmd.Help != "" {
+			sb.WriteString(" - " + cmd.Help)
+		}
+		if len(cmd.Aliases) > 0 {
+			sb.WriteString(" (also /" + strings.Join(cmd.Aliases, ", /") + ")")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,59 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"chloe/acl"
+	"chloe/util"
+)
+
+// configCheck validates config.yml and acl.yml without starting the bot,
+// it prints every problem and returns the exit code
+func configCheck(args []string) int {
+	var opts options
+	_ = newFlagSet("chloe config check", &opts).Parse(args)
+
+	failed := false
+	config, err := util.LoadConfig(opts.configPath)
+	if err != nil {
+		failed = true
+		var configErr *util.ConfigError
+		if errors.As(err, &configErr) {
+			fmt.Printf("%s: %d problem(s)\n", opts.configPath, len(configErr.Problems))
+			for _, p := range configErr.Problems {
+				fmt.Printf("  %s\n", p)
+			}
+		} else {
+			fmt.Printf("%s: %v\n", opts.configPath, err)
+		}
+	} else {
+		fmt.Printf("%s: ok\n", opts.configPath)
+	}
+
+	aclPaths := []string{opts.aclPath}
+	checked := map[string]bool{opts.aclPath: true}
+	for _, inst := range config.Instances() {
+		if inst.ACL != "" && !checked[inst.ACL] {
+			aclPaths = append(aclPaths, inst.ACL)
+			checked[inst.ACL] = true
+		}
+	}
+	for _, path := range aclPaths {
+		if _, err := acl.Load(path); err != nil {
+			failed = true
+			fmt.Printf("%s: %v\n", path, err)
+		} else {
+			fmt.Printf("%s: ok\n", path)
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
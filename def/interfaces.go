@@ -4,8 +4,18 @@
 
 package def
 
+import "context"
+
 /// IM interface
 
+// ids are prefixed by the adapter they come from
+const (
+	PrefixTelegram = "tg-"
+	PrefixRemote   = "rm-"
+)
+
+var IDPrefixes = []string{PrefixTelegram, PrefixRemote}
+
 type ChatID string
 type UserID string
 type MessageID string
@@ -31,6 +41,7 @@ type Chat interface {
 	QuoteMessage(message string, replyTo MessageID, quote string)
 	ReplyImage(string, MessageID)
 	ReplyVoice(aud string, to MessageID)
+	ReplyFile(file string, to MessageID)
 	GetSelf() User
 }
 
@@ -40,49 +51,255 @@ type User interface {
 	GetUserName() string
 }
 
+// Localized is implemented by users whose IM tells their language
+type Localized interface {
+	// GetLanguageCode is an IETF language tag like "en" or "pt-br", empty if unknown
+	GetLanguageCode() string
+}
+
 type Message interface {
 	GetID() MessageID
 	GetUser() User
 	GetChat() Chat
 	GetText() string
-	GetVoice() (string, CleanFunc)
+	// GetVoice returns the downloaded recording of the message, a Recorded message
+	// downloads it on the first call. err tells why a recording it has could not
+	// be downloaded.
+	GetVoice() (file string, cleaner CleanFunc, err error)
+	// GetReplyTo returns the message this one replies to, nil if it is no reply
+	GetReplyTo() *ReplyTo
+}
+
+// ReplyTo is the message another message replies to
+type ReplyTo struct {
+	ID MessageID
+	// User wrote the message, nil if the IM doesn't tell
+	User User
+	// Text is the text or caption of the message, empty if the IM doesn't tell
+	Text string
+}
+
+// Correlated is implemented by messages that carry the correlation id the adapter
+// logged them with, so the log lines of one message can be found together
+type Correlated interface {
+	GetCorrelationID() string
+}
+
+// Traced is implemented by messages that carry the ctx of the span the adapter
+// received them in, so the handling of the message continues that trace
+type Traced interface {
+	GetTraceContext() context.Context
+}
+
+// Recorded is implemented by messages that download their recording only when it is
+// needed and can tell a voice message from other recordings like audio files and videos
+type Recorded interface {
+	// HasRecording tells if the message has a recording, without downloading it
+	HasRecording() bool
+	// IsVoiceNote tells if the recording of the message is a voice message
+	IsVoiceNote() bool
+	// Discard removes the downloaded recording, GetVoice downloads nothing after it
+	Discard()
 }
 
 type MessageBot interface {
 	GetMessages() <-chan Message
+	// GetChat returns the chat with the given id, or nil if the chat does not belong to this bot
+	GetChat(ChatID) Chat
+}
+
+// Button is an inline button under a message, its Data comes back in a Callback when it is pressed
+type Button struct {
+	Text string
+	Data string
+}
+
+// ButtonChat is implemented by chats that can show inline buttons
+type ButtonChat interface {
+	SendButtons(m string, buttons [][]Button)
+	ReplyButtons(m string, to MessageID, buttons [][]Button)
+	// EditMessage replaces the text of a message sent by the bot and removes its buttons
+	EditMessage(id MessageID, m string)
+}
+
+// ChatAction is what the bot shows it is doing while the user waits
+type ChatAction string
+
+const (
+	ActionTyping         ChatAction = "typing"
+	ActionUploadPhoto    ChatAction = "upload_photo"
+	ActionRecordVoice    ChatAction = "record_voice"
+	ActionUploadDocument ChatAction = "upload_document"
+)
+
+// ActionChat is implemented by chats that can show what the bot is doing
+type ActionChat interface {
+	// StartAction shows the action until the returned func is called
+	StartAction(ChatAction) (stop func())
+}
+
+// Callback is a press on an inline button
+type Callback interface {
+	GetUser() User
+	GetChat() Chat
+	GetMessageID() MessageID
+	GetData() string
+	// Answer shows a short notice to the user who pressed the button
+	Answer(text string)
+}
+
+// CallbackSource is implemented by bots whose IM has inline buttons
+type CallbackSource interface {
+	GetCallbacks() <-chan Callback
+}
+
+// InlineResult is one result offered for an inline query, an image if ImageURL is set
+type InlineResult struct {
+	ID          string
+	Title       string
+	Description string
+	// Text is sent to the chat when the result is picked
+	Text     string
+	ImageURL string
+}
+
+// InlineQuery is text typed after the bot's username in any chat,
+// the user picks one of the results to send there
+type InlineQuery interface {
+	GetID() string
+	GetUser() User
+	GetText() string
+	Answer(results []InlineResult)
+	// Refuse offers no results but a button to the private chat with the bot,
+	// the private chat starts with /start and the parameter
+	Refuse(text, startParameter string)
+}
+
+// InlineSource is implemented by bots whose IM has inline queries
+type InlineSource interface {
+	GetInlineQueries() <-chan InlineQuery
 }
 
 type Debuggable interface {
 	SetDebug(bool)
 }
 
+type CommandInfo struct {
+	Name        string
+	Description string
+}
+
+// CommandSetter is implemented by bots whose IM can show a command menu
+type CommandSetter interface {
+	SetCommands([]CommandInfo) error
+}
+
+// StopWaiter is implemented by bots that finish stopping in the background once their ctx is done
+type StopWaiter interface {
+	WaitStopped()
+}
+
+// HealthChecker is implemented by bots and AI services that can tell if they are
+// connected, for the health endpoints of the admin server
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
 /// AI interface
 
 type ConversationId int64
 
+// Usage is what a call to the model consumed
+type Usage struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+func (u Usage) TotalTokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
 type Conversation interface {
 	GetID() ConversationId
-	Ask(string) string
+	Ask(ctx context.Context, q string) (string, Usage)
+}
+
+// Regenerator is implemented by conversations that can take back their last answer
+type Regenerator interface {
+	// Regenerate answers q again, the last answer is forgotten if it was to q
+	Regenerate(ctx context.Context, q string) (string, Usage)
+}
+
+// Remark is something said in a group chat
+type Remark struct {
+	Speaker string
+	Text    string
+}
+
+// GroupConversation is implemented by conversations that tell the model who says what
+type GroupConversation interface {
+	// AskAs asks q for the speaker, background is what the group said
+	// without addressing the bot since the last question
+	AskAs(ctx context.Context, speaker, q string, background []Remark) (string, Usage)
+}
+
+// ModelSelector is implemented by conversations that can switch the model
+type ModelSelector interface {
+	GetModel() string
+	SetModel(string)
 }
 
 type ConversationFactory interface {
 	GetTalk(ChatID) Conversation
 }
 
+// Completer is implemented by conversation factories that answer a single prompt
+// apart from any conversation, with no persona and no history
+type Completer interface {
+	// Complete answers the prompt, system is the system prompt, none if empty
+	Complete(ctx context.Context, system, prompt string) (string, Usage)
+}
+
 type SpeechToText interface {
-	Convert(voiceFile string) (string, error)
+	Convert(ctx context.Context, voiceFile string) (string, error)
 }
 
 type TextToSpeech interface {
-	Convert(text string) (string, CleanFunc, error)
+	Convert(ctx context.Context, text string) (string, CleanFunc, error)
 }
 
 type ImageGenerator interface {
-	Generate(desc, size string) (string, CleanFunc, error)
+	Generate(ctx context.Context, desc, size string) (string, CleanFunc, error)
+}
+
+// ImageLinker is implemented by image generators that can leave the image online,
+// for IMs that take an image by its url
+type ImageLinker interface {
+	// GenerateURL returns a link to the image, it expires after a while
+	GenerateURL(ctx context.Context, desc, size string) (string, error)
 }
 
 /// for service
 
+type Permission string
+
+const (
+	PermChat  Permission = "chat"
+	PermDraw  Permission = "draw"
+	PermVoice Permission = "voice"
+	PermTTS   Permission = "tts"
+	PermModel Permission = "model"
+	PermAdmin Permission = "admin"
+)
+
+// MessageSender sends to a chat outside a reply, like plugins and scheduled jobs do
+type MessageSender interface {
+	SendMessage(ChatID, string) error
+}
+
 type BotService interface {
-	Run()
+	MessageSender
+	// Run handles messages until ctx is done, then finishes the work in hand and returns
+	Run(ctx context.Context)
 }
@@ -6,35 +6,51 @@ package im
 
 import (
 	"chloe/def"
+	"chloe/logging"
+	"chloe/metrics"
+	"chloe/tracing"
 	"context"
+	"errors"
 	"io"
+	"log/slog"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	psg "chloe/proto/service/go"
 
-	log "github.com/jeanphorn/log4go"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	// remote message, for M$ Teams or else
-	preRM = "rm-"
+	preRM = def.PrefixRemote
+
+	// how long pending calls may take to finish on shutdown
+	remoteStopTimeout = 30 * time.Second
 )
 
-func NewRemoteChatBot(port string) (def.MessageBot, error) {
+// NewRemoteChatBot serves remote chats on the port until ctx is done
+func NewRemoteChatBot(ctx context.Context, port string) (def.MessageBot, error) {
 	bot := &remoteBot{
 		msgQueue:      make(chan def.Message, 100),
 		outStream:     make(chan *psg.Message, 100),
 		replyChannels: sync.Map{},
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
 	}
 
 	lis, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		log.Error("fail to start grpc server on port %s", port, err)
+		slog.Error("failed to start grpc server", "port", port, "err", err)
+		return nil, err
 	}
 	var opts []grpc.ServerOption
 
@@ -46,7 +62,31 @@ func NewRemoteChatBot(port string) (def.MessageBot, error) {
 
 	grpcServer := grpc.NewServer(opts...)
 	psg.RegisterChattingServer(grpcServer, newRemoteChatServer(bot))
-	go grpcServer.Serve(lis)
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			slog.Error("grpc server failed", "port", port, "err", err)
+			bot.serveErr.Store(err)
+		}
+	}()
+
+	go func() {
+		defer close(bot.stopped)
+		<-ctx.Done()
+		close(bot.done)
+
+		// pending calls wait for their replies, don't wait forever
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(remoteStopTimeout):
+			grpcServer.Stop()
+		}
+		slog.Info("grpc server stopped", "port", port)
+	}()
 
 	return bot, nil
 }
@@ -70,9 +110,11 @@ func (s *remoteChatServer) Chat(ctx context.Context, msg *psg.Message) (*psg.Mes
 	user := msg.Sender
 
 	rMsg := &remoteMessage{
-		bot:  s.bot,
-		id:   msg.Id,
-		text: msg.Text,
+		bot:       s.bot,
+		id:        msg.Id,
+		text:      msg.Text,
+		replyToId: msg.ReplyToId,
+		reqId:     logging.NewID(),
 		chat: &remoteChat{
 			bot: s.bot,
 			id:  chatId,
@@ -90,11 +132,22 @@ func (s *remoteChatServer) Chat(ctx context.Context, msg *psg.Message) (*psg.Mes
 	}
 	s.bot.replyChannels.Store(key, ch)
 
-	s.bot.msgQueue <- rMsg
+	span := rMsg.startTrace(ctx)
+	select {
+	case s.bot.msgQueue <- rMsg:
+		span.End()
+		metrics.MessageReceived(metrics.AdapterRemote)
+		rMsg.received()
+	case <-s.bot.done:
+		span.End()
+		s.bot.replyChannels.Delete(key)
+		return nil, status.Error(codes.Unavailable, "shutting down")
+	}
 
 	replyMsgList := &psg.MessageList{}
 	for replyMsg := range ch {
 		replyMsgList.Messages = append(replyMsgList.Messages, replyMsg)
+		metrics.MessageSent(metrics.AdapterRemote, metrics.KindText, nil)
 	}
 
 	s.bot.replyChannels.Delete(key)
@@ -110,7 +163,7 @@ func (s *remoteChatServer) ChatStream(stream psg.Chatting_ChatStreamServer) erro
 				break
 			}
 			if err != nil {
-				// TODO log
+				slog.Info("grpc chat stream closed", "err", err)
 				break
 			}
 
@@ -120,9 +173,11 @@ func (s *remoteChatServer) ChatStream(stream psg.Chatting_ChatStreamServer) erro
 			user := msg.Sender
 
 			rMsg := &remoteMessage{
-				bot:  s.bot,
-				id:   msg.Id,
-				text: msg.Text,
+				bot:       s.bot,
+				id:        msg.Id,
+				text:      msg.Text,
+				replyToId: msg.ReplyToId,
+				reqId:     logging.NewID(),
 				chat: &remoteChat{
 					bot: s.bot,
 					id:  chatId,
@@ -133,24 +188,52 @@ func (s *remoteChatServer) ChatStream(stream psg.Chatting_ChatStreamServer) erro
 				},
 			}
 
-			s.bot.msgQueue <- rMsg
+			span := rMsg.startTrace(stream.Context())
+			select {
+			case s.bot.msgQueue <- rMsg:
+				span.End()
+				metrics.MessageReceived(metrics.AdapterRemote)
+				rMsg.received()
+			case <-s.bot.done:
+				span.End()
+				return
+			}
 		}
 	}()
 
-	for msg := range s.bot.outStream {
-		retry := 5
-		for retry > 0 {
-			if err := stream.Send(msg); err != nil {
-				log.Error("failed to send response: ", err)
-				retry--
-				time.Sleep(5 * time.Second)
-			} else {
-				break
+	for {
+		select {
+		case msg := <-s.bot.outStream:
+			s.send(stream, msg)
+		case <-stream.Context().Done():
+			return nil
+		case <-s.bot.done:
+			// hand over what is queued, then let the server stop
+			for {
+				select {
+				case msg := <-s.bot.outStream:
+					s.send(stream, msg)
+				default:
+					return nil
+				}
 			}
 		}
 	}
+}
 
-	return nil
+func (s *remoteChatServer) send(stream psg.Chatting_ChatStreamServer, msg *psg.Message) {
+	var err error
+	retry := 5
+	for retry > 0 {
+		if err = stream.Send(msg); err != nil {
+			slog.Error("failed to send to grpc chat stream", "retries", retry-1, "err", err)
+			retry--
+			time.Sleep(5 * time.Second)
+		} else {
+			break
+		}
+	}
+	metrics.MessageSent(metrics.AdapterRemote, metrics.KindText, err)
 }
 
 type messageKey struct {
@@ -162,18 +245,57 @@ type remoteBot struct {
 	msgQueue      chan def.Message
 	outStream     chan *psg.Message
 	replyChannels sync.Map
+	// closed when the bot stops taking messages
+	done chan struct{}
+	// closed when the grpc server stopped
+	stopped chan struct{}
+	// why the grpc server stopped serving, if it did
+	serveErr atomic.Value
 }
 
 func (bot *remoteBot) GetMessages() <-chan def.Message {
 	return bot.msgQueue
 }
 
+func (bot *remoteBot) WaitStopped() {
+	<-bot.stopped
+}
+
+// CheckHealth fails once the grpc server stopped serving
+func (bot *remoteBot) CheckHealth(ctx context.Context) error {
+	if err, failed := bot.serveErr.Load().(error); failed {
+		return err
+	}
+	select {
+	case <-bot.done:
+		return errors.New("stopped")
+	default:
+		return nil
+	}
+}
+
+func (bot *remoteBot) GetChat(id def.ChatID) def.Chat {
+	if !strings.HasPrefix(id.String(), preRM) {
+		return nil
+	}
+	return &remoteChat{
+		bot: bot,
+		id:  id.String()[len(preRM):],
+	}
+}
+
 type remoteMessage struct {
 	bot  *remoteBot
 	id   string
 	text string
 	chat *remoteChat
 	from *remoteUser
+	// correlation id of the log lines
+	reqId string
+	// ctx of the span the message was received in
+	traceCtx context.Context
+	// id of the message this one replies to, empty if it is no reply
+	replyToId string
 }
 
 type remoteChat struct {
@@ -190,6 +312,33 @@ func (m *remoteMessage) GetChat() def.Chat {
 	return m.chat
 }
 
+func (m *remoteMessage) GetCorrelationID() string {
+	return m.reqId
+}
+
+func (m *remoteMessage) GetTraceContext() context.Context {
+	return m.traceCtx
+}
+
+// startTrace starts the span of receiving the message, it ends once the message is queued
+func (m *remoteMessage) startTrace(ctx context.Context) trace.Span {
+	var span trace.Span
+	m.traceCtx, span = tracing.Start(ctx, "receive message",
+		tracing.KeyAdapter.String(metrics.AdapterRemote),
+		tracing.KeyRequest.String(m.reqId),
+		tracing.KeyChat.String(m.chat.GetID().String()),
+	)
+	return span
+}
+
+func (m *remoteMessage) received() {
+	slog.Debug("message received",
+		logging.KeyRequest, m.reqId,
+		logging.KeyChat, m.chat.GetID().String(),
+		"adapter", metrics.AdapterRemote,
+	)
+}
+
 func (m *remoteMessage) GetID() def.MessageID {
 	return def.MessageID(preRM + m.id)
 }
@@ -202,9 +351,17 @@ func (m *remoteMessage) GetUser() def.User {
 	return m.from
 }
 
-func (m *remoteMessage) GetVoice() (string, def.CleanFunc) {
+func (m *remoteMessage) GetVoice() (string, def.CleanFunc, error) {
 	// TODO
-	return "", func() {}
+	return "", func() {}, nil
+}
+
+func (m *remoteMessage) GetReplyTo() *def.ReplyTo {
+	if m.replyToId == "" {
+		return nil
+	}
+	// the rpc only tells the id of the replied message
+	return &def.ReplyTo{ID: def.MessageID(preRM + m.replyToId)}
 }
 
 // User
@@ -232,7 +389,21 @@ func (c *remoteChat) GetMemberCount() int {
 }
 
 func (c *remoteChat) SendMessage(m string) {
-	// TODO
+	msg := &psg.Message{
+		Text: m,
+		Chat: &psg.Chat{
+			Id: c.stripId(c.id),
+		},
+	}
+
+	// there is no reply channel waiting for a message we start, so it can only go
+	// to the stream. don't block the caller if no client is draining the stream.
+	select {
+	case c.bot.outStream <- msg:
+	default:
+		slog.Warn("remote out stream is full, message dropped", logging.KeyChat, c.GetID().String())
+		metrics.MessageSent(metrics.AdapterRemote, metrics.KindText, errors.New("dropped"))
+	}
 }
 
 func (c *remoteChat) GetSelf() def.User {
@@ -289,6 +460,16 @@ func (c *remoteChat) ReplyVoice(aud string, to def.MessageID) {
 	panic("unimplemented")
 }
 
+func (c *remoteChat) ReplyFile(file string, to def.MessageID) {
+	// no file transfer in the rpc yet, text files are sent as they are
+	content, err := os.ReadFile(file)
+	if err != nil {
+		slog.Error("read file failed", "file", file, "err", err)
+		return
+	}
+	c.ReplyMessage(string(content), to)
+}
+
 func (c *remoteChat) stripId(id string) string {
 	if strings.HasPrefix(id, preRM) {
 		return id[len(preRM):]
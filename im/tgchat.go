@@ -5,43 +5,78 @@
 package im
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"chloe/def"
+	"chloe/logging"
+	"chloe/media"
+	"chloe/metrics"
+	"chloe/tracing"
 	"chloe/util"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	log "github.com/jeanphorn/log4go"
 )
 
 const (
 	// prefix for Telegram IDs
-	preTG = "tg-"
+	preTG = def.PrefixTelegram
+
+	// telegram shows a chat action for 5 seconds
+	actionRefresh = 4 * time.Second
+	// an action not stopped by then is stopped anyway
+	actionLimit = 5 * time.Minute
+
+	// longest a spoken answer may take to become a voice message
+	voiceConvertTimeout = time.Minute
+
+	// seconds telegram may keep inline results for the same query of the same user
+	inlineCacheTime = 300
+	// characters of the text sent by an inline result
+	inlineTextLimit = 4096
 )
 
 type TelegramBot struct {
-	msgQueue chan def.Message
-	api      *tgbotapi.BotAPI
-	cache    *chatCache
+	msgQueue      chan def.Message
+	callbackQueue chan def.Callback
+	inlineQueue   chan def.InlineQuery
+	api           *tgbotapi.BotAPI
+	cache         *chatCache
+	// spoken answers are sent as voice messages, or as mp3 files if false
+	voiceNotes bool
+	media      *media.Transcoder
+	// closed when polling stopped
+	stopped chan struct{}
 }
 
-func NewTelegramBot(token string) (def.MessageBot, error) {
+// NewTelegramBot starts polling telegram, it stops when ctx is done
+func NewTelegramBot(ctx context.Context, cfg util.TelegramConfig, transcoder *media.Transcoder) (def.MessageBot, error) {
 	bot := &TelegramBot{
-		msgQueue: make(chan def.Message, 100),
-		cache:    newChatCache(),
+		msgQueue:      make(chan def.Message, 100),
+		callbackQueue: make(chan def.Callback, 100),
+		inlineQueue:   make(chan def.InlineQuery, 100),
+		cache:         newChatCache(),
+		voiceNotes:    cfg.VoiceFormat != util.VoiceFormatAudio,
+		media:         transcoder,
+		stopped:       make(chan struct{}),
 	}
 
-	api, err := tgbotapi.NewBotAPI(token)
+	api, err := tgbotapi.NewBotAPI(cfg.BotToken)
 	if err != nil {
-		log.Error("failed to initialize telegram bot")
+		slog.Error("failed to initialize telegram bot", "err", err)
 		return nil, err
 	}
 	bot.api = api
 
-	go bot.messageLoop()
+	go bot.messageLoop(ctx)
 
 	return bot, nil
 }
@@ -50,49 +85,168 @@ func (bot *TelegramBot) GetMessages() <-chan def.Message {
 	return bot.msgQueue
 }
 
+func (bot *TelegramBot) GetCallbacks() <-chan def.Callback {
+	return bot.callbackQueue
+}
+
+func (bot *TelegramBot) GetInlineQueries() <-chan def.InlineQuery {
+	return bot.inlineQueue
+}
+
+func (bot *TelegramBot) GetChat(id def.ChatID) def.Chat {
+	if !strings.HasPrefix(id.String(), preTG) {
+		return nil
+	}
+	return bot.lookupChat(id)
+}
+
+func (bot *TelegramBot) SetCommands(cmds []def.CommandInfo) error {
+	var botCmds []tgbotapi.BotCommand
+	for _, cmd := range cmds {
+		desc := cmd.Description
+		if desc == "" {
+			desc = cmd.Name
+		}
+		botCmds = append(botCmds, tgbotapi.BotCommand{
+			Command:     cmd.Name,
+			Description: desc,
+		})
+	}
+	_, err := bot.api.Request(tgbotapi.NewSetMyCommands(botCmds...))
+	return err
+}
+
 func (bot *TelegramBot) SetDebug(debug bool) {
 	bot.api.Debug = debug
 }
 
-func (bot *TelegramBot) messageLoop() {
+func (bot *TelegramBot) WaitStopped() {
+	<-bot.stopped
+}
+
+// CheckHealth asks telegram who the bot is, which fails if telegram can't be reached
+func (bot *TelegramBot) CheckHealth(ctx context.Context) error {
+	_, err := bot.api.GetMe()
+	return err
+}
+
+// messageLoop polls telegram until ctx is done, replies can still be sent afterwards
+func (bot *TelegramBot) messageLoop(ctx context.Context) {
+	defer close(bot.stopped)
+
 	cfg := tgbotapi.NewUpdate(0)
 	cfg.Timeout = 120
 
 	updates := bot.api.GetUpdatesChan(cfg)
 
-	for update := range updates {
-		if update.Message != nil { // If we got a message
-			var m def.Message
-			if update.Message.Voice != nil {
-				// process voice
-				fd := update.Message.Voice.FileID
-				link, err := bot.api.GetFileDirectURL(fd)
-				if err != nil {
-					log.Warn("failed to get voice download link")
-				}
-				log.Debug("voice file link %s", link)
-				voiceFile, cleaner := util.DownloadTempFile(link)
-				m = &tgMessage{
-					id: def.MessageID(
-						preTG + strconv.FormatInt(int64(update.Message.MessageID), 10),
-					),
-					userId:     def.UserID(preTG + strconv.FormatInt(update.Message.From.ID, 10)),
-					chatId:     def.ChatID(preTG + strconv.FormatInt(update.Message.Chat.ID, 10)),
-					bot:        bot,
-					audioFile:  voiceFile,
-					audioClean: cleaner,
-				}
-			} else if update.Message.Text != "" {
-				m = &tgMessage{
-					id:     def.MessageID(preTG + strconv.FormatInt(int64(update.Message.MessageID), 10)),
-					userId: def.UserID(preTG + strconv.FormatInt(update.Message.From.ID, 10)),
-					chatId: def.ChatID(preTG + strconv.FormatInt(update.Message.Chat.ID, 10)),
-					bot:    bot,
-					text:   update.Message.Text,
-				}
+	for {
+		select {
+		case <-ctx.Done():
+			bot.api.StopReceivingUpdates()
+			slog.Info("telegram polling stopped", "bot", bot.api.Self.UserName)
+			return
+		case update, ok := <-updates:
+			if !ok {
+				return
 			}
+			bot.handleUpdate(ctx, update)
+		}
+	}
+}
+
+// handleUpdate queues messages and button presses, nobody reads them once ctx is done
+func (bot *TelegramBot) handleUpdate(ctx context.Context, update tgbotapi.Update) {
+	if update.Message != nil { // If we got a message
+		reqId := logging.NewID()
+		chatId := preTG + strconv.FormatInt(update.Message.Chat.ID, 10)
+		logger := slog.With(
+			logging.KeyRequest, reqId,
+			logging.KeyChat, chatId,
+		)
+		// the span ends once the message is queued, its handling continues the trace
+		traceCtx, span := tracing.Start(ctx, "receive message",
+			tracing.KeyAdapter.String(metrics.AdapterTelegram),
+			tracing.KeyRequest.String(reqId),
+			tracing.KeyChat.String(chatId),
+		)
+		defer span.End()
+		var m def.Message
+		// voice, audio and videos are transcribed, they are downloaded by the task
+		// so polling doesn't wait for them
+		fd, size := soundFileOf(update.Message)
+		if fd != "" {
+			m = &tgMessage{
+				id: def.MessageID(
+					preTG + strconv.FormatInt(int64(update.Message.MessageID), 10),
+				),
+				userId:    def.UserID(preTG + strconv.FormatInt(update.Message.From.ID, 10)),
+				chatId:    def.ChatID(preTG + strconv.FormatInt(update.Message.Chat.ID, 10)),
+				bot:       bot,
+				reqId:     reqId,
+				traceCtx:  traceCtx,
+				text:      update.Message.Caption,
+				audioFd:   fd,
+				audioSize: size,
+				voiceNote: update.Message.Voice != nil,
+				replyTo:   replyToOf(update.Message),
+			}
+		} else if update.Message.Text != "" {
+			m = &tgMessage{
+				id:       def.MessageID(preTG + strconv.FormatInt(int64(update.Message.MessageID), 10)),
+				userId:   def.UserID(preTG + strconv.FormatInt(update.Message.From.ID, 10)),
+				chatId:   def.ChatID(preTG + strconv.FormatInt(update.Message.Chat.ID, 10)),
+				bot:      bot,
+				reqId:    reqId,
+				traceCtx: traceCtx,
+				text:     update.Message.Text,
+				replyTo:  replyToOf(update.Message),
+			}
+		}
 
-			bot.msgQueue <- m
+		if m != nil {
+			metrics.MessageReceived(metrics.AdapterTelegram)
+			logger.Debug("message received", "adapter", metrics.AdapterTelegram)
+		}
+		select {
+		case bot.msgQueue <- m:
+		case <-ctx.Done():
+		}
+	} else if query := update.CallbackQuery; query != nil && query.Message != nil {
+		cb := &tgCallback{
+			id:        query.ID,
+			messageId: def.MessageID(preTG + strconv.Itoa(query.Message.MessageID)),
+			chatId:    def.ChatID(preTG + strconv.FormatInt(query.Message.Chat.ID, 10)),
+			user: &tgUser{
+				id:           def.UserID(preTG + strconv.FormatInt(query.From.ID, 10)),
+				firstName:    query.From.FirstName,
+				userName:     query.From.UserName,
+				languageCode: query.From.LanguageCode,
+				chatId:       def.ChatID(preTG + strconv.FormatInt(query.Message.Chat.ID, 10)),
+			},
+			data: query.Data,
+			bot:  bot,
+		}
+		select {
+		case bot.callbackQueue <- cb:
+		case <-ctx.Done():
+		}
+	} else if query := update.InlineQuery; query != nil && query.From != nil {
+		iq := &tgInlineQuery{
+			id:   query.ID,
+			text: query.Query,
+			user: &tgUser{
+				id:           def.UserID(preTG + strconv.FormatInt(query.From.ID, 10)),
+				firstName:    query.From.FirstName,
+				userName:     query.From.UserName,
+				languageCode: query.From.LanguageCode,
+				// the private chat with a user has the user's id
+				chatId: def.ChatID(preTG + strconv.FormatInt(query.From.ID, 10)),
+			},
+			bot: bot,
+		}
+		select {
+		case bot.inlineQueue <- iq:
+		case <-ctx.Done():
 		}
 	}
 }
@@ -133,14 +287,15 @@ func (bot *TelegramBot) lookupUser(uid def.UserID, cid def.ChatID) def.User {
 	}
 	chatMember, err := bot.api.GetChatMember(chatMembersConfig)
 	if err != nil {
-		log.Error("failed to get user %v", uid)
+		slog.Error("failed to get user", logging.KeyUser, uid.String(), logging.KeyChat, cid.String(), "err", err)
 		return nil
 	}
 	user = &tgUser{
-		id:        uid,
-		firstName: chatMember.User.FirstName,
-		userName:  chatMember.User.UserName,
-		chatId:    cid,
+		id:           uid,
+		firstName:    chatMember.User.FirstName,
+		userName:     chatMember.User.UserName,
+		languageCode: chatMember.User.LanguageCode,
+		chatId:       cid,
 	}
 
 	bot.cache.cacheChatUser(cid, uid, user)
@@ -149,12 +304,26 @@ func (bot *TelegramBot) lookupUser(uid def.UserID, cid def.ChatID) def.User {
 }
 
 type tgMessage struct {
-	id         def.MessageID
-	userId     def.UserID
-	chatId     def.ChatID
-	text       string
+	id     def.MessageID
+	userId def.UserID
+	chatId def.ChatID
+	text   string
+	// file id and size of the recording, downloaded on the first GetVoice
+	audioFd    string
+	audioSize  int
+	audioLock  sync.Mutex
+	audioDone  bool
 	audioFile  string
 	audioClean def.CleanFunc
+	// why the recording of the message was not downloaded
+	audioErr error
+	// the recording is a voice message, not audio or a video
+	voiceNote bool
+	// correlation id of the log lines
+	reqId string
+	// ctx of the span the message was received in
+	traceCtx context.Context
+	replyTo  *def.ReplyTo
 
 	bot *TelegramBot
 }
@@ -163,6 +332,14 @@ func (m *tgMessage) GetID() def.MessageID {
 	return m.id
 }
 
+func (m *tgMessage) GetCorrelationID() string {
+	return m.reqId
+}
+
+func (m *tgMessage) GetTraceContext() context.Context {
+	return m.traceCtx
+}
+
 func (m *tgMessage) GetUser() def.User {
 	return m.bot.lookupUser(m.userId, m.chatId)
 }
@@ -175,8 +352,96 @@ func (m *tgMessage) GetText() string {
 	return m.text
 }
 
-func (m *tgMessage) GetVoice() (string, def.CleanFunc) {
-	return m.audioFile, m.audioClean
+func (m *tgMessage) GetVoice() (string, def.CleanFunc, error) {
+	m.audioLock.Lock()
+	defer m.audioLock.Unlock()
+	if m.audioFd != "" && !m.audioDone {
+		m.audioDone = true
+		m.audioFile, m.audioClean, m.audioErr = m.bot.downloadSound(m.audioFd, m.audioSize)
+	}
+	return m.audioFile, m.Discard, m.audioErr
+}
+
+func (m *tgMessage) HasRecording() bool {
+	return m.audioFd != ""
+}
+
+func (m *tgMessage) IsVoiceNote() bool {
+	return m.voiceNote
+}
+
+func (m *tgMessage) Discard() {
+	m.audioLock.Lock()
+	defer m.audioLock.Unlock()
+	m.audioDone = true
+	if m.audioClean != nil {
+		m.audioClean()
+		m.audioClean = nil
+	}
+	m.audioFile = ""
+}
+
+func (m *tgMessage) GetReplyTo() *def.ReplyTo {
+	return m.replyTo
+}
+
+// downloadSound downloads a file to transcribe, unless it is too large for that
+func (bot *TelegramBot) downloadSound(fd string, size int) (string, def.CleanFunc, error) {
+	if maxSize := bot.media.MaxSize(); int64(size) > maxSize {
+		return "", nil, fmt.Errorf("%w: %d bytes, up to %d", media.ErrTooLarge, size, maxSize)
+	}
+	link, err := bot.api.GetFileDirectURL(fd)
+	if err != nil {
+		return "", nil, err
+	}
+	file, cleaner := util.DownloadTempFile(link)
+	if file == "" {
+		return "", nil, errors.New("download failed")
+	}
+	return file, cleaner, nil
+}
+
+// soundFileOf returns the file id and size of the voice, audio, video note, video
+// or audio document of m, an empty id if it has none
+func soundFileOf(m *tgbotapi.Message) (string, int) {
+	switch {
+	case m.Voice != nil:
+		return m.Voice.FileID, m.Voice.FileSize
+	case m.Audio != nil:
+		return m.Audio.FileID, m.Audio.FileSize
+	case m.VideoNote != nil:
+		return m.VideoNote.FileID, m.VideoNote.FileSize
+	case m.Video != nil:
+		return m.Video.FileID, m.Video.FileSize
+	case m.Document != nil && strings.HasPrefix(m.Document.MimeType, "audio/"):
+		return m.Document.FileID, m.Document.FileSize
+	}
+	return "", 0
+}
+
+// replyToOf returns the message m replies to, nil if it is no reply
+func replyToOf(m *tgbotapi.Message) *def.ReplyTo {
+	replied := m.ReplyToMessage
+	if replied == nil {
+		return nil
+	}
+	r := &def.ReplyTo{
+		ID:   def.MessageID(preTG + strconv.Itoa(replied.MessageID)),
+		Text: replied.Text,
+	}
+	if r.Text == "" {
+		r.Text = replied.Caption
+	}
+	if replied.From != nil {
+		r.User = &tgUser{
+			id:           def.UserID(preTG + strconv.FormatInt(replied.From.ID, 10)),
+			firstName:    replied.From.FirstName,
+			userName:     replied.From.UserName,
+			languageCode: replied.From.LanguageCode,
+			chatId:       def.ChatID(preTG + strconv.FormatInt(m.Chat.ID, 10)),
+		}
+	}
+	return r
 }
 
 type tgChat struct {
@@ -195,27 +460,84 @@ func (c *tgChat) GetMemberCount() int {
 }
 
 func (c *tgChat) SendMessage(m string) {
-	// TODO
+	c.sendText(m, 0, nil)
 }
 
 func (c *tgChat) ReplyMessage(m string, to def.MessageID) {
+	c.sendText(m, c.bot.getIntMessageId(to), nil)
+}
+
+func (c *tgChat) SendButtons(m string, buttons [][]def.Button) {
+	c.sendText(m, 0, buttons)
+}
+
+func (c *tgChat) ReplyButtons(m string, to def.MessageID, buttons [][]def.Button) {
+	c.sendText(m, c.bot.getIntMessageId(to), buttons)
+}
+
+// StartAction sends the action again and again until stopped, telegram drops it
+// by itself when a message is sent
+func (c *tgChat) StartAction(action def.ChatAction) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(actionRefresh)
+		defer ticker.Stop()
+		limit := time.After(actionLimit)
+		for {
+			chatAction := tgbotapi.NewChatAction(c.bot.getInt64ChatId(c.id), string(action))
+			if _, err := c.bot.api.Request(chatAction); err != nil {
+				slog.Debug("failed to send chat action", logging.KeyChat, c.id.String(), "action", string(action), "err", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			case <-limit:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func (c *tgChat) EditMessage(id def.MessageID, m string) {
+	edit := tgbotapi.NewEditMessageText(c.bot.getInt64ChatId(c.id), c.bot.getIntMessageId(id), m)
+	if _, err := c.bot.api.Send(edit); err != nil {
+		slog.Warn("failed to edit message", logging.KeyChat, c.id.String(), "message", id.String(), "err", err)
+	}
+}
+
+// sendText sends m as markdown and falls back to plain text if telegram rejects it,
+// replyTo 0 means not replying to any message
+func (c *tgChat) sendText(m string, replyTo int, buttons [][]def.Button) {
+	var markup any
+	if len(buttons) > 0 {
+		markup = inlineKeyboard(buttons)
+	}
 
 	mksafe := escapeSafeForMarkdown(m)
 	msg := tgbotapi.NewMessage(c.bot.getInt64ChatId(c.id), mksafe)
 	msg.ParseMode = "MarkdownV2"
-	msg.ReplyToMessageID = c.bot.getIntMessageId(to)
+	msg.ReplyToMessageID = replyTo
+	msg.ReplyMarkup = markup
 
 	_, err := c.bot.api.Send(msg)
 	if err != nil {
-		log.Info("error: %#v in sending message: %#v", err, msg)
+		slog.Info("failed to send message as markdown, retry as plain text", logging.KeyChat, c.id.String(), "err", err)
 		fallbackMsg := tgbotapi.NewMessage(c.bot.getInt64ChatId(c.id), m)
 		fallbackMsg.ParseMode = ""
-		fallbackMsg.ReplyToMessageID = c.bot.getIntMessageId(to)
-		_, err := c.bot.api.Send(fallbackMsg)
+		fallbackMsg.ReplyToMessageID = replyTo
+		fallbackMsg.ReplyMarkup = markup
+		_, err = c.bot.api.Send(fallbackMsg)
 		if err != nil {
-			log.Info("error: %#v in retry sending message: %#v", err, fallbackMsg)
+			slog.Warn("failed to send message", logging.KeyChat, c.id.String(), logging.Text("text", m), "err", err)
 		}
 	}
+	metrics.MessageSent(metrics.AdapterTelegram, metrics.KindText, err)
 }
 
 func (c *tgChat) QuoteMessage(m string, to def.MessageID, quote string) {
@@ -230,21 +552,22 @@ func (c *tgChat) QuoteMessage(m string, to def.MessageID, quote string) {
 
 	_, err := c.bot.api.Send(msg)
 	if err != nil {
-		log.Info("error: %#v in sending message: %#v", err, mksafe)
+		slog.Warn("failed to send message", logging.KeyChat, c.id.String(), logging.Text("text", m), "err", err)
 	}
+	metrics.MessageSent(metrics.AdapterTelegram, metrics.KindText, err)
 }
 
 func (c *tgChat) ReplyImage(img string, to def.MessageID) {
 	f, err := os.Open(img)
 	if err != nil {
-		log.Error("open image file %s failed, %v", img, err)
+		slog.Error("open image file failed", "file", img, "err", err)
 		return
 	}
 	defer f.Close()
 
 	fileInfo, err := f.Stat()
 	if err != nil {
-		log.Error("stat image file %s failed, %v", img, err)
+		slog.Error("stat image file failed", "file", img, "err", err)
 		return
 	}
 	fileSize := fileInfo.Size()
@@ -252,7 +575,7 @@ func (c *tgChat) ReplyImage(img string, to def.MessageID) {
 	buffer := make([]byte, fileSize)
 	_, err = f.Read(buffer)
 	if err != nil {
-		log.Error("read image file %s failed, %v", img, err)
+		slog.Error("read image file failed", "file", img, "err", err)
 		return
 	}
 
@@ -263,52 +586,90 @@ func (c *tgChat) ReplyImage(img string, to def.MessageID) {
 
 	photoMsg := tgbotapi.NewPhoto(c.bot.getInt64ChatId(c.id), requestFileData)
 	photoMsg.ReplyToMessageID = c.bot.getIntMessageId(to)
-	if _, err = c.bot.api.Send(photoMsg); err != nil {
-		log.Error("failed to send image to user")
+	_, err = c.bot.api.Send(photoMsg)
+	if err != nil {
+		slog.Error("failed to send image", logging.KeyChat, c.id.String(), "err", err)
 	}
+	metrics.MessageSent(metrics.AdapterTelegram, metrics.KindImage, err)
 }
 
+// ReplyVoice sends the audio as a voice message, or as an audio file if the bot
+// is configured so or the audio can't be converted to OGG/Opus
 func (c *tgChat) ReplyVoice(aud string, to def.MessageID) {
-	f, err := os.Open(aud)
+	if c.bot.voiceNotes {
+		ctx, cancel := context.WithTimeout(context.Background(), voiceConvertTimeout)
+		ogg, info, cleaner, err := c.bot.media.Transcode(ctx, aud, media.Opus)
+		cancel()
+		if err == nil {
+			defer cleaner()
+			c.sendVoice(ogg, info.Duration, to)
+			return
+		}
+		slog.Warn("failed to convert to a voice message, sent as audio", logging.KeyChat, c.id.String(), "file", aud, "err", err)
+	}
+
+	requestFileData, err := fileBytes(aud)
 	if err != nil {
-		log.Error("open audio file %s failed, %v", aud, err)
+		slog.Error("read audio file failed", "file", aud, "err", err)
 		return
 	}
-	defer f.Close()
-
-	fileInfo, err := f.Stat()
+	audioMsg := tgbotapi.NewAudio(c.bot.getInt64ChatId(c.id), requestFileData)
+	audioMsg.ReplyToMessageID = c.bot.getIntMessageId(to)
+	audioMsg.Duration = c.durationSeconds(aud)
+	_, err = c.bot.api.Send(audioMsg)
+	metrics.MessageSent(metrics.AdapterTelegram, metrics.KindVoice, err)
 	if err != nil {
-		log.Error("stat audio file %s failed, %v", aud, err)
+		slog.Error("failed to send voice", logging.KeyChat, c.id.String(), "err", err)
 		return
 	}
-	fileSize := fileInfo.Size()
+	slog.Debug("audio sent", logging.KeyChat, c.id.String(), "file", aud, "size", len(requestFileData.Bytes))
+}
 
-	buffer := make([]byte, fileSize)
-	_, err = f.Read(buffer)
+// sendVoice sends an OGG/Opus file, telegram draws its waveform from the audio
+// since the bot api takes none
+func (c *tgChat) sendVoice(ogg string, duration time.Duration, to def.MessageID) {
+	requestFileData, err := fileBytes(ogg)
+	if err != nil {
+		slog.Error("read voice file failed", "file", ogg, "err", err)
+		return
+	}
+	voiceMsg := tgbotapi.NewVoice(c.bot.getInt64ChatId(c.id), requestFileData)
+	voiceMsg.ReplyToMessageID = c.bot.getIntMessageId(to)
+	voiceMsg.Duration = int(duration.Round(time.Second) / time.Second)
+	_, err = c.bot.api.Send(voiceMsg)
+	metrics.MessageSent(metrics.AdapterTelegram, metrics.KindVoice, err)
 	if err != nil {
-		log.Error("read audio file %s failed, %v", aud, err)
+		slog.Error("failed to send voice", logging.KeyChat, c.id.String(), "err", err)
 		return
 	}
+	slog.Debug("voice sent", logging.KeyChat, c.id.String(), "file", ogg, "size", len(requestFileData.Bytes))
+}
 
-	requestFileData := &tgbotapi.FileBytes{
-		Name:  filepath.Base(f.Name()),
-		Bytes: buffer,
+// durationSeconds is the length of the audio rounded to seconds, 0 if unknown
+func (c *tgChat) durationSeconds(file string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), voiceConvertTimeout)
+	defer cancel()
+	info, err := c.bot.media.Probe(ctx, file)
+	if err != nil {
+		return 0
 	}
+	return int(info.Duration.Round(time.Second) / time.Second)
+}
 
-	/*
-		var media tgbotapi.MediaGroupConfig
-		vm := tgbotapi.NewInputMediaAudio(requestFileData)
-		media.Media = append(media.Media, vm)
-		voiceMsg := tgbotapi.NewMediaGroup(int64(c.id), media.Media)
-	*/
-	voiceMsg := tgbotapi.NewAudio(c.bot.getInt64ChatId(c.id), requestFileData)
-	voiceMsg.ReplyToMessageID = c.bot.getIntMessageId(to)
-	if _, err = c.bot.api.Send(voiceMsg); err != nil {
-		log.Error("failed to send image to user %v", err)
+func (c *tgChat) ReplyFile(file string, to def.MessageID) {
+	requestFileData, err := fileBytes(file)
+	if err != nil {
+		slog.Error("read file failed", "file", file, "err", err)
 		return
 	}
-	log.Debug("send size %d voice file %s", fileSize, aud)
 
+	docMsg := tgbotapi.NewDocument(c.bot.getInt64ChatId(c.id), requestFileData)
+	docMsg.ReplyToMessageID = c.bot.getIntMessageId(to)
+	_, err = c.bot.api.Send(docMsg)
+	if err != nil {
+		slog.Error("failed to send file", logging.KeyChat, c.id.String(), "err", err)
+	}
+	metrics.MessageSent(metrics.AdapterTelegram, metrics.KindFile, err)
 }
 
 func (c *tgChat) GetSelf() def.User {
@@ -321,9 +682,10 @@ func (c *tgChat) GetSelf() def.User {
 }
 
 type tgUser struct {
-	id        def.UserID
-	firstName string
-	userName  string
+	id           def.UserID
+	firstName    string
+	userName     string
+	languageCode string
 
 	chatId def.ChatID
 }
@@ -340,6 +702,132 @@ func (u *tgUser) GetUserName() string {
 	return u.userName
 }
 
+func (u *tgUser) GetLanguageCode() string {
+	return u.languageCode
+}
+
+type tgCallback struct {
+	id        string
+	messageId def.MessageID
+	chatId    def.ChatID
+	user      *tgUser
+	data      string
+
+	bot *TelegramBot
+}
+
+func (cb *tgCallback) GetUser() def.User {
+	return cb.user
+}
+
+func (cb *tgCallback) GetChat() def.Chat {
+	return cb.bot.lookupChat(cb.chatId)
+}
+
+func (cb *tgCallback) GetMessageID() def.MessageID {
+	return cb.messageId
+}
+
+func (cb *tgCallback) GetData() string {
+	return cb.data
+}
+
+func (cb *tgCallback) Answer(text string) {
+	if _, err := cb.bot.api.Request(tgbotapi.NewCallback(cb.id, text)); err != nil {
+		slog.Warn("failed to answer callback", "err", err)
+	}
+}
+
+type tgInlineQuery struct {
+	id   string
+	text string
+	user *tgUser
+
+	bot *TelegramBot
+}
+
+func (q *tgInlineQuery) GetID() string {
+	return q.id
+}
+
+func (q *tgInlineQuery) GetUser() def.User {
+	return q.user
+}
+
+func (q *tgInlineQuery) GetText() string {
+	return q.text
+}
+
+func (q *tgInlineQuery) Answer(results []def.InlineResult) {
+	var items []any
+	for _, r := range results {
+		if r.ImageURL != "" {
+			photo := tgbotapi.NewInlineQueryResultPhotoWithThumb(r.ID, r.ImageURL, r.ImageURL)
+			photo.Title = r.Title
+			photo.Description = r.Description
+			photo.Caption = r.Text
+			items = append(items, photo)
+			continue
+		}
+		article := tgbotapi.NewInlineQueryResultArticle(r.ID, r.Title, truncate(r.Text, inlineTextLimit))
+		article.Description = r.Description
+		items = append(items, article)
+	}
+	q.answer(tgbotapi.InlineConfig{
+		InlineQueryID: q.id,
+		Results:       items,
+		CacheTime:     inlineCacheTime,
+		IsPersonal:    true,
+	})
+}
+
+func (q *tgInlineQuery) Refuse(text, startParameter string) {
+	q.answer(tgbotapi.InlineConfig{
+		InlineQueryID:     q.id,
+		Results:           []any{},
+		IsPersonal:        true,
+		SwitchPMText:      text,
+		SwitchPMParameter: startParameter,
+	})
+}
+
+func (q *tgInlineQuery) answer(config tgbotapi.InlineConfig) {
+	if _, err := q.bot.api.Request(config); err != nil {
+		slog.Warn("failed to answer inline query", logging.KeyUser, q.user.id.String(), "err", err)
+	}
+}
+
+// truncate cuts s to at most limit characters
+func truncate(s string, limit int) string {
+	if r := []rune(s); len(r) > limit {
+		return string(r[:limit-1]) + "…"
+	}
+	return s
+}
+
+func inlineKeyboard(buttons [][]def.Button) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, row := range buttons {
+		var keys []tgbotapi.InlineKeyboardButton
+		for _, b := range row {
+			keys = append(keys, tgbotapi.NewInlineKeyboardButtonData(b.Text, b.Data))
+		}
+		rows = append(rows, keys)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func fileBytes(path string) (*tgbotapi.FileBytes, error) {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tgbotapi.FileBytes{
+		Name:  filepath.Base(path),
+		Bytes: buffer,
+	}, nil
+}
+
 func escapeSafeForMarkdown(s string) string {
 	s = strings.ReplaceAll(s, "!", `\!`)
 	s = strings.ReplaceAll(s, ".", `\.`)
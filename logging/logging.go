@@ -0,0 +1,247 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+	// chloe.log in the log directory, rotated by size
+	OutputFile = "file"
+
+	// attribute keys used across the bot
+	KeyRequest = "req"
+	KeyBot     = "bot"
+	KeyUser    = "user"
+	KeyChat    = "chat"
+	// the trace id when the message is traced
+	KeyTrace = "trace"
+)
+
+var (
+	Levels  = []string{"debug", "info", "warn", "error"}
+	Formats = []string{FormatText, FormatJSON}
+	Outputs = []string{OutputStdout, OutputStderr, OutputFile}
+)
+
+// Config is the log section of config.yml
+type Config struct {
+	// debug, info, warn or error, info by default
+	Level string `yaml:"level"`
+	// text or json, text by default
+	Format string `yaml:"format"`
+	// stdout, stderr and file, stdout and file by default
+	Outputs []string `yaml:"outputs"`
+	// log what users write and what the bot answers, off by default
+	MessageText bool `yaml:"messageText"`
+}
+
+// Validate reports every value the logger can't run with, prefixed by the yaml path
+func (c Config) Validate(prefix string) []string {
+	var problems []string
+	if c.Level != "" && !slices.Contains(Levels, c.Level) {
+		problems = append(problems, fmt.Sprintf("%slevel: '%s' is not one of %s", prefix, c.Level, strings.Join(Levels, ", ")))
+	}
+	if c.Format != "" && !slices.Contains(Formats, c.Format) {
+		problems = append(problems, fmt.Sprintf("%sformat: '%s' is not one of %s", prefix, c.Format, strings.Join(Formats, ", ")))
+	}
+	for i, out := range c.Outputs {
+		if !slices.Contains(Outputs, out) {
+			problems = append(problems, fmt.Sprintf("%soutputs[%d]: '%s' is not one of %s", prefix, i, out, strings.Join(Outputs, ", ")))
+		}
+	}
+	return problems
+}
+
+var (
+	level       = new(slog.LevelVar)
+	messageText atomic.Bool
+
+	guard   sync.Mutex
+	file    io.Closer
+	secrets []string
+)
+
+// secrets that look like an openai api key or a telegram bot token, also inside urls
+var secretPattern = regexp.MustCompile(`sk-[A-Za-z0-9_-]{16,}|[0-9]{6,}:[A-Za-z0-9_-]{30,}`)
+
+// Setup makes the configured logger the default of slog, the log file goes to dir.
+// It can be called again, the level and message text also change by Reconfigure.
+func Setup(cfg Config, dir string) error {
+	outputs := cfg.Outputs
+	if len(outputs) == 0 {
+		outputs = []string{OutputStdout, OutputFile}
+	}
+
+	guard.Lock()
+	defer guard.Unlock()
+
+	var writers []io.Writer
+	var newFile io.Closer
+	for _, out := range outputs {
+		switch out {
+		case OutputStdout:
+			writers = append(writers, os.Stdout)
+		case OutputStderr:
+			writers = append(writers, os.Stderr)
+		case OutputFile:
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return fmt.Errorf("failed to create log directory %s, %v", dir, err)
+			}
+			rotated := &lumberjack.Logger{
+				Filename:   filepath.Join(dir, "chloe.log"),
+				MaxSize:    5, // megabytes
+				MaxBackups: 5,
+			}
+			writers = append(writers, rotated)
+			newFile = rotated
+		default:
+			return fmt.Errorf("unknown log output '%s'", out)
+		}
+	}
+
+	opts := &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+	w := io.MultiWriter(writers...)
+	var handler slog.Handler
+	if cfg.Format == FormatJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	applyLocked(cfg)
+
+	if file != nil {
+		_ = file.Close()
+	}
+	file = newFile
+	return nil
+}
+
+// Reconfigure applies the settings that can change while running, the level and
+// message text. Format and outputs need a restart.
+func Reconfigure(cfg Config) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	applyLocked(cfg)
+}
+
+func applyLocked(cfg Config) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(cfg.Level)); err != nil {
+		l = slog.LevelInfo
+	}
+	level.Set(l)
+	messageText.Store(cfg.MessageText)
+}
+
+// Close flushes and closes the log file, call it last
+func Close() {
+	guard.Lock()
+	defer guard.Unlock()
+
+	if file != nil {
+		_ = file.Close()
+		file = nil
+	}
+}
+
+// AddSecrets makes the values show up as [redacted] in the log, like api keys and bot tokens
+func AddSecrets(values ...string) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	for _, v := range values {
+		if v != "" && !slices.Contains(secrets, v) {
+			secrets = append(secrets, v)
+		}
+	}
+}
+
+// Text is an attribute with what a user wrote or the bot answered,
+// only its length is logged unless log.messageText is on
+func Text(key, text string) slog.Attr {
+	if messageText.Load() {
+		return slog.String(key, text)
+	}
+	return slog.String(key, fmt.Sprintf("[%d chars]", len([]rune(text))))
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if s := scrub(a.Value.String()); s != a.Value.String() {
+			return slog.String(a.Key, s)
+		}
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok && err != nil {
+			return slog.String(a.Key, scrub(err.Error()))
+		}
+	}
+	return a
+}
+
+func scrub(s string) string {
+	guard.Lock()
+	known := secrets
+	guard.Unlock()
+
+	for _, secret := range known {
+		s = strings.ReplaceAll(s, secret, "[redacted]")
+	}
+	return secretPattern.ReplaceAllString(s, "[redacted]")
+}
+
+type loggerKey struct{}
+
+// NewID returns a short random id that ties the log lines of one message together
+func NewID() string {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "000000000000"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// WithLogger returns a ctx that carries the logger, see FromContext
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger of the message being handled, with its
+// correlation id, or the default logger outside of a message
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
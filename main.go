@@ -5,48 +5,119 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
+	"chloe/acl"
 	"chloe/botservice"
 	"chloe/im"
+	"chloe/logging"
+	"chloe/tracing"
 	"chloe/util"
 
-	log "github.com/jeanphorn/log4go"
+	// plugins register their commands in init
+	_ "chloe/plugins/whoami"
 )
 
-func initLog() {
-	exe, err := os.Executable()
-	if err != nil {
-		panic(err)
-	}
-	exPath := filepath.Dir(exe)
-	logPath := filepath.Join(exPath, "log")
-	// init log
-	flw := log.NewFileLogWriter(filepath.Join(logPath, "chloe.log"), true, true)
-	flw.SetFormat("[%D %T] [%L] (%S) %M")
-	flw.SetRotate(true)
-	flw.SetRotateDaily(true)
-	flw.SetRotateSize(1024 * 1024 * 5)
-	flw.SetRotateMaxBackup(5)
-	log.AddFilter("DEFAULT", log.DEBUG, flw)
+type options struct {
+	configPath string
+	aclPath    string
+	logDir     string
+}
+
+// newFlagSet declares the path flags shared by all subcommands,
+// CHLOE_CONFIG_FILE, CHLOE_ACL_FILE and CHLOE_LOG_DIR set their defaults
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&opts.configPath, "config", envOr(util.EnvConfigFile, util.DefaultPath("config.yml")), "config file")
+	fs.StringVar(&opts.aclPath, "acl", envOr(util.EnvACLFile, util.DefaultPath("acl.yml")), "access control file")
+	fs.StringVar(&opts.logDir, "log", envOr(util.EnvLogDir, ""), "log directory, log next to the config file by default")
+	return fs
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
 }
 
 func main() {
-	initLog()
-	log.Info("openai bot Chloe Started.")
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		os.Exit(configCheck(os.Args[3:]))
+	}
 
-	config := util.ReadConfig()
-	acl := util.ReadAccessList()
-	service := botservice.NewTgBotService(config, acl)
+	var opts options
+	_ = newFlagSet("chloe", &opts).Parse(os.Args[1:])
+	if opts.logDir == "" {
+		opts.logDir = filepath.Join(filepath.Dir(opts.configPath), "log")
+	}
 
-	service.Run()
+	// the log settings are in the config, an invalid config is logged with the defaults
+	config, err := util.LoadConfig(opts.configPath)
+	logConfig := config.Log
+	if err != nil {
+		logConfig = logging.Config{}
+	}
+	if err := logging.Setup(logConfig, opts.logDir); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up logging, %v\n", err)
+		os.Exit(1)
+	}
+	logging.AddSecrets(config.Secrets()...)
+	slog.Info("openai bot Chloe started")
+	if err != nil {
+		fail("failed to load config", "path", opts.configPath, "err", err)
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), config.Tracing)
+	if err != nil {
+		fail("failed to set up tracing", "err", err)
+	}
+	accessControl, err := acl.Load(opts.aclPath)
+	if err != nil {
+		fail("failed to load acl", "path", opts.aclPath, "err", err)
+	}
+	// SIGINT and SIGTERM stop taking messages, running tasks finish first
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	service, err := botservice.NewHost(ctx, config, accessControl)
+	if err != nil {
+		fail("failed to set up bots", "err", err)
+	}
+
+	service.Run(ctx)
+	// spans still batched would be lost, give the collector a moment
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("failed to flush traces", "err", err)
+	}
+	cancel()
+	slog.Info("openai bot Chloe stopped")
+	logging.Close()
+}
+
+// fail logs the error and exits, the log is flushed first
+func fail(msg string, args ...any) {
+	slog.Error(msg, args...)
+	// the log may only go to a file, tell whoever started the bot too
+	line := msg
+	for i := 0; i+1 < len(args); i += 2 {
+		line += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	fmt.Fprintln(os.Stderr, line)
+	logging.Close()
+	os.Exit(1)
 }
 
 func main2() {
 	fmt.Println("hello grpc")
-	im.NewRemoteChatBot("2952")
+	im.NewRemoteChatBot(context.Background(), "2952")
 	time.Sleep(time.Hour)
 }
@@ -0,0 +1,367 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chloe/def"
+	"chloe/logging"
+	"chloe/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// telegram bots can't download larger files anyway
+	defaultMaxSize     = 20
+	defaultMaxDuration = 30 * time.Minute
+	defaultTimeout     = 2 * time.Minute
+
+	// bytes of ffmpeg's complaints kept in a ToolError
+	stderrLimit = 512
+	// how long a killed tool may keep its output open
+	waitDelay = time.Second
+)
+
+var (
+	// ErrTooLarge is returned for input files over the size limit
+	ErrTooLarge = errors.New("media file is too large")
+	// ErrTooLong is returned for input that plays longer than the duration limit
+	ErrTooLong = errors.New("media is too long")
+	// ErrNoAudio is returned for input without an audio stream
+	ErrNoAudio = errors.New("media has no audio")
+	// ErrUnknownFormat is returned for a target format the transcoder doesn't know
+	ErrUnknownFormat = errors.New("unknown media format")
+)
+
+// ToolError is a failed run of ffmpeg or ffprobe, also when it was canceled
+type ToolError struct {
+	Tool string
+	// Stderr is the end of what the tool complained
+	Stderr string
+	Err    error
+}
+
+func (e *ToolError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("%s failed, %v", e.Tool, e.Err)
+	}
+	return fmt.Sprintf("%s failed, %v: %s", e.Tool, e.Err, e.Stderr)
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
+// Config is the media section of config.yml
+type Config struct {
+	// megabytes of a file to transcode, 20 by default
+	MaxSize int `yaml:"maxSize"`
+	// seconds of audio to transcode, 1800 by default
+	MaxDuration int `yaml:"maxDuration"`
+	// seconds one ffmpeg run may take before it is killed, 120 by default
+	Timeout int `yaml:"timeout"`
+}
+
+// Validate reports every value the transcoder can't run with, prefixed by the yaml path
+func (c Config) Validate(prefix string) []string {
+	var problems []string
+	for name, value := range map[string]int{
+		"maxSize":     c.MaxSize,
+		"maxDuration": c.MaxDuration,
+		"timeout":     c.Timeout,
+	} {
+		if value < 0 {
+			problems = append(problems, fmt.Sprintf("%s%s: %d is negative", prefix, name, value))
+		}
+	}
+	return problems
+}
+
+// Format is a kind of file the bot needs
+type Format string
+
+const (
+	// MP3 is mono mp3 at 16 kHz, all whisper listens to
+	MP3 Format = "mp3"
+	// Opus is mono OGG/Opus, what telegram plays as a voice message
+	Opus Format = "opus"
+)
+
+type spec struct {
+	ext  string
+	args []string
+	// tells if the input is fine as it is
+	matches func(Info) bool
+}
+
+var specs = map[Format]spec{
+	MP3: {
+		ext:     ".mp3",
+		args:    []string{"-ac", "1", "-ar", "16000", "-c:a", "libmp3lame", "-b:a", "64k", "-f", "mp3"},
+		matches: func(info Info) bool { return info.Format == "mp3" },
+	},
+	Opus: {
+		ext:     ".ogg",
+		args:    []string{"-ac", "1", "-ar", "48000", "-c:a", "libopus", "-b:a", "32k", "-application", "voip", "-f", "ogg"},
+		matches: func(info Info) bool { return info.Format == "ogg" && info.Codec == "opus" },
+	},
+}
+
+// Info is what ffprobe tells about a file
+type Info struct {
+	// Format is the container like "ogg" or "mov,mp4,m4a,3gp,3g2,mj2"
+	Format string
+	// Codec is the codec of the first audio stream, empty without audio
+	Codec    string
+	Duration time.Duration
+	Size     int64
+}
+
+func (info Info) HasAudio() bool {
+	return info.Codec != ""
+}
+
+// Transcoder converts media with ffmpeg within the configured limits
+type Transcoder struct {
+	guard       sync.RWMutex
+	maxSize     int64
+	maxDuration time.Duration
+	timeout     time.Duration
+}
+
+func NewTranscoder(cfg Config) *Transcoder {
+	t := &Transcoder{}
+	t.Reconfigure(cfg)
+	return t
+}
+
+// Reconfigure applies new limits to the files transcoded from now on
+func (t *Transcoder) Reconfigure(cfg Config) {
+	t.guard.Lock()
+	defer t.guard.Unlock()
+
+	t.maxSize = int64(cfg.MaxSize) << 20
+	if cfg.MaxSize == 0 {
+		t.maxSize = defaultMaxSize << 20
+	}
+	t.maxDuration = time.Duration(cfg.MaxDuration) * time.Second
+	if cfg.MaxDuration == 0 {
+		t.maxDuration = defaultMaxDuration
+	}
+	t.timeout = time.Duration(cfg.Timeout) * time.Second
+	if cfg.Timeout == 0 {
+		t.timeout = defaultTimeout
+	}
+}
+
+// MaxSize is the size in bytes of the largest file to transcode
+func (t *Transcoder) MaxSize() int64 {
+	maxSize, _, _ := t.limits()
+	return maxSize
+}
+
+func (t *Transcoder) limits() (int64, time.Duration, time.Duration) {
+	t.guard.RLock()
+	defer t.guard.RUnlock()
+
+	return t.maxSize, t.maxDuration, t.timeout
+}
+
+// Probe tells the format, audio codec, duration and size of the file
+func (t *Transcoder) Probe(ctx context.Context, file string) (Info, error) {
+	_, _, timeout := t.limits()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return probe(ctx, file)
+}
+
+// Transcode converts the file into the format, a file already in it is returned as it is.
+// The input is checked against the limits first, info is what it was probed as.
+// A failed or canceled run leaves no output behind.
+func (t *Transcoder) Transcode(ctx context.Context, file string, to Format) (string, Info, def.CleanFunc, error) {
+	s, known := specs[to]
+	if !known {
+		return "", Info{}, nil, fmt.Errorf("%w: %s", ErrUnknownFormat, to)
+	}
+	maxSize, maxDuration, timeout := t.limits()
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		return "", Info{}, nil, err
+	}
+	if stat.Size() > maxSize {
+		return "", Info{}, nil, fmt.Errorf("%w: %d MB, up to %d MB", ErrTooLarge, stat.Size()>>20, maxSize>>20)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "ffmpeg convert", attribute.String("chloe.format", string(to)))
+	defer func() { tracing.End(span, err) }()
+
+	info, err := probe(ctx, file)
+	if err != nil {
+		return "", info, nil, err
+	}
+	span.SetAttributes(attribute.String("chloe.input", info.Format), attribute.Float64("chloe.seconds", info.Duration.Seconds()))
+	if !info.HasAudio() {
+		err = ErrNoAudio
+		return "", info, nil, err
+	}
+	if info.Duration > maxDuration {
+		err = fmt.Errorf("%w: %v, up to %v", ErrTooLong, info.Duration.Round(time.Second), maxDuration)
+		return "", info, nil, err
+	}
+	if s.matches(info) {
+		return file, info, func() {}, nil
+	}
+
+	out, err := os.CreateTemp("", "*"+s.ext)
+	if err != nil {
+		return "", info, nil, err
+	}
+	out.Close()
+	outPath := out.Name()
+	clean := func() { _ = os.Remove(outPath) }
+
+	args := append([]string{"-nostdin", "-y", "-v", "error", "-i", file, "-vn"}, s.args...)
+	if _, err = run(ctx, "ffmpeg", append(args, outPath)...); err != nil {
+		clean()
+		logging.FromContext(ctx).Warn("failed to transcode", "file", file, "format", to, "err", err)
+		return "", info, nil, err
+	}
+	return outPath, info, clean, nil
+}
+
+// Split cuts an mp3 into parts of at most maxBytes and maxLength, in the order they play.
+// A file that fits is returned as the only part, the cleaner removes the parts it made.
+func (t *Transcoder) Split(ctx context.Context, file string, maxBytes int64, maxLength time.Duration) ([]string, def.CleanFunc, error) {
+	_, _, timeout := t.limits()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	info, err := probe(ctx, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	length := maxLength
+	if info.Size > 0 && info.Duration > 0 {
+		// a tenth less than what fits, the bitrate of a part varies
+		bySize := time.Duration(float64(info.Duration) * float64(maxBytes) / float64(info.Size) * 0.9)
+		if bySize < length {
+			length = bySize
+		}
+	}
+	if info.Duration <= length && info.Size <= maxBytes {
+		return []string{file}, func() {}, nil
+	}
+	if length < time.Second {
+		return nil, nil, fmt.Errorf("%w: parts of %d bytes are too small", ErrTooLarge, maxBytes)
+	}
+
+	dir, err := os.MkdirTemp("", "parts*")
+	if err != nil {
+		return nil, nil, err
+	}
+	clean := func() { _ = os.RemoveAll(dir) }
+
+	ctx, span := tracing.Start(ctx, "ffmpeg split", attribute.Float64("chloe.seconds", info.Duration.Seconds()))
+	_, err = run(ctx, "ffmpeg", "-nostdin", "-v", "error", "-i", file,
+		"-f", "segment",
+		"-segment_time", strconv.FormatFloat(length.Seconds(), 'f', 0, 64),
+		"-c", "copy",
+		filepath.Join(dir, "%04d.mp3"),
+	)
+	tracing.End(span, err)
+	if err != nil {
+		clean()
+		return nil, nil, err
+	}
+
+	parts, err := filepath.Glob(filepath.Join(dir, "*.mp3"))
+	if err != nil || len(parts) == 0 {
+		clean()
+		return nil, nil, fmt.Errorf("no parts split from %s, %v", file, err)
+	}
+	sort.Strings(parts)
+	return parts, clean, nil
+}
+
+type probeOutput struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		Size       string `json:"size"`
+	} `json:"format"`
+}
+
+func probe(ctx context.Context, file string) (Info, error) {
+	out, err := run(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=format_name,duration,size:stream=codec_type,codec_name",
+		"-of", "json",
+		file,
+	)
+	if err != nil {
+		return Info{}, err
+	}
+
+	var parsed probeOutput
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return Info{}, &ToolError{Tool: "ffprobe", Err: err}
+	}
+	info := Info{Format: parsed.Format.FormatName}
+	for _, stream := range parsed.Streams {
+		if stream.CodecType == "audio" {
+			info.Codec = stream.CodecName
+			break
+		}
+	}
+	// both are N/A for some streams
+	if seconds, err := strconv.ParseFloat(parsed.Format.Duration, 64); err == nil {
+		info.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	if size, err := strconv.ParseInt(parsed.Format.Size, 10, 64); err == nil {
+		info.Size = size
+	}
+	return info, nil
+}
+
+// run runs the tool, it is killed when ctx is done
+func run(ctx context.Context, tool string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = waitDelay
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		complaint := strings.TrimSpace(stderr.String())
+		if len(complaint) > stderrLimit {
+			complaint = complaint[len(complaint)-stderrLimit:]
+		}
+		return nil, &ToolError{Tool: tool, Stderr: complaint, Err: err}
+	}
+	return stdout.Bytes(), nil
+}
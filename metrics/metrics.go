@@ -0,0 +1,167 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// adapters
+const (
+	AdapterTelegram = "telegram"
+	AdapterRemote   = "remote"
+)
+
+// kinds of messages sent
+const (
+	KindText  = "text"
+	KindImage = "image"
+	KindVoice = "voice"
+	KindFile  = "file"
+)
+
+// AI backends
+const (
+	BackendChat         = "openai-chat"
+	BackendImage        = "openai-image"
+	BackendSpeechToText = "openai-whisper"
+	BackendTextToSpeech = "pyservice-tts"
+)
+
+const (
+	namespace = "chloe"
+
+	outcomeOK    = "ok"
+	outcomeError = "error"
+
+	tokenTypePrompt     = "prompt"
+	tokenTypeCompletion = "completion"
+)
+
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Messages received, by adapter.",
+	}, []string{"adapter"})
+
+	messagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_sent_total",
+		Help:      "Messages sent, by adapter, kind and outcome.",
+	}, []string{"adapter", "kind", "outcome"})
+
+	tasksQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tasks_queued",
+		Help:      "Messages waiting in the task queue.",
+	})
+
+	tasksRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tasks_running",
+		Help:      "Messages being handled by the task queue.",
+	})
+
+	tasksRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_rejected_total",
+		Help:      "Messages turned away because the task queue was full.",
+	})
+
+	aiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ai_request_duration_seconds",
+		Help:      "Duration of requests to the AI backends, including text to speech and speech to text.",
+		Buckets:   []float64{0.25, 0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"backend", "outcome"})
+
+	aiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ai_errors_total",
+		Help:      "Failed requests to the AI backends.",
+	}, []string{"backend"})
+
+	tokensUsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Tokens used, by model and type.",
+	}, []string{"model", "type"})
+
+	imagesGenerated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_generated_total",
+		Help:      "Images generated, by size.",
+	}, []string{"size"})
+
+	audioTranscribed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audio_transcribed_seconds_total",
+		Help:      "Seconds of audio transcribed.",
+	})
+)
+
+func MessageReceived(adapter string) {
+	messagesReceived.WithLabelValues(adapter).Inc()
+}
+
+// MessageSent counts a message the adapter sent, or failed to send if err is not nil
+func MessageSent(adapter, kind string, err error) {
+	messagesSent.WithLabelValues(adapter, kind, outcomeOf(err)).Inc()
+}
+
+// TaskQueued counts a message waiting in the task queue
+func TaskQueued() {
+	tasksQueued.Inc()
+}
+
+// TaskStarted moves a message from waiting to running
+func TaskStarted() {
+	tasksQueued.Dec()
+	tasksRunning.Inc()
+}
+
+func TaskDone() {
+	tasksRunning.Dec()
+}
+
+func TaskRejected() {
+	tasksRejected.Inc()
+}
+
+// ObserveAI records the duration and outcome of a request to the backend started at start
+func ObserveAI(backend string, start time.Time, err error) {
+	aiDuration.WithLabelValues(backend, outcomeOf(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		aiErrors.WithLabelValues(backend).Inc()
+	}
+}
+
+func TokensUsed(model string, prompt, completion int) {
+	if prompt > 0 {
+		tokensUsed.WithLabelValues(model, tokenTypePrompt).Add(float64(prompt))
+	}
+	if completion > 0 {
+		tokensUsed.WithLabelValues(model, tokenTypeCompletion).Add(float64(completion))
+	}
+}
+
+func ImagesGenerated(size string, n int) {
+	imagesGenerated.WithLabelValues(size).Add(float64(n))
+}
+
+func AudioTranscribed(seconds float64) {
+	audioTranscribed.Add(seconds)
+}
+
+func outcomeOf(err error) string {
+	if err != nil {
+		return outcomeError
+	}
+	return outcomeOK
+}
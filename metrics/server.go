@@ -0,0 +1,187 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// how long one health check may take
+	checkTimeout = 5 * time.Second
+	// results are reused for this long, probes must not hammer telegram or openai
+	checkCacheTime = 10 * time.Second
+)
+
+// Check tells if a dependency is usable, nil means healthy
+type Check func(ctx context.Context) error
+
+type checkResult struct {
+	err  error
+	time time.Time
+}
+
+// Server is the admin http server with /metrics, /healthz and /readyz.
+// Liveness checks are the adapters, readiness checks also the AI backends.
+type Server struct {
+	guard    sync.Mutex
+	addr     string
+	live     map[string]Check
+	ready    map[string]Check
+	results  map[string]checkResult
+	stopping bool
+}
+
+func NewServer(addr string) *Server {
+	return &Server{
+		addr:    addr,
+		live:    make(map[string]Check),
+		ready:   make(map[string]Check),
+		results: make(map[string]checkResult),
+	}
+}
+
+// AddLiveness adds a check to /healthz and /readyz
+func (s *Server) AddLiveness(name string, check Check) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+
+	s.live[name] = check
+	s.ready[name] = check
+}
+
+// AddReadiness adds a check to /readyz
+func (s *Server) AddReadiness(name string, check Check) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+
+	s.ready[name] = check
+}
+
+// Run serves until ctx is done
+func (s *Server) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.serveChecks(w, r, s.live, false)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s.serveChecks(w, r, s.ready, true)
+	})
+
+	server := &http.Server{
+		Addr:              s.addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("admin server listening", "addr", s.addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("admin server failed", "addr", s.addr, "err", err)
+	}
+}
+
+// Stopping fails /readyz from now on, metrics are still served while the tasks drain
+func (s *Server) Stopping() {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+
+	s.stopping = true
+}
+
+func (s *Server) serveChecks(w http.ResponseWriter, r *http.Request, checks map[string]Check, readiness bool) {
+	s.guard.Lock()
+	stopping := s.stopping
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	s.guard.Unlock()
+	sort.Strings(names)
+
+	errs := s.runChecks(r.Context(), names, checks)
+
+	healthy := true
+	var sb strings.Builder
+	if stopping && readiness {
+		healthy = false
+		sb.WriteString("shutdown: shutting down\n")
+	}
+	for i, name := range names {
+		if errs[i] != nil {
+			healthy = false
+			fmt.Fprintf(&sb, "%s: %v\n", name, errs[i])
+		} else {
+			fmt.Fprintf(&sb, "%s: ok\n", name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write([]byte(sb.String()))
+}
+
+// runChecks runs the checks in parallel, a recent result is taken from the cache
+func (s *Server) runChecks(ctx context.Context, names []string, checks map[string]Check) []error {
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		s.guard.Lock()
+		result, cached := s.results[name]
+		check := checks[name]
+		s.guard.Unlock()
+		if cached && time.Since(result.time) < checkCacheTime {
+			errs[i] = result.err
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, name string, check Check) {
+			defer wg.Done()
+			errs[i] = runCheck(ctx, check)
+
+			s.guard.Lock()
+			s.results[name] = checkResult{err: errs[i], time: time.Now()}
+			s.guard.Unlock()
+		}(i, name, check)
+	}
+	wg.Wait()
+	return errs
+}
+
+// runCheck gives up on a check after checkTimeout even if it ignores ctx
+func runCheck(ctx context.Context, check Check) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out, %v", ctx.Err())
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package pipeline
+
+import (
+	"context"
+	"sync"
+
+	"chloe/def"
+)
+
+// Context carries one incoming message through the stages, stages enrich it
+// for the ones after them
+type Context struct {
+	// Ctx is canceled when the bot shuts down and can't wait for the message any longer
+	Ctx     context.Context
+	Service def.MessageSender
+	Message def.Message
+	User    def.User
+	Chat    def.Chat
+	// Text is the message text, the transcription stage fills it for voice messages
+	Text string
+	// Recording tells if the message has a recording, the transcription stage
+	// downloads it
+	Recording bool
+	// Voice is the downloaded voice file, set by the transcription stage
+	Voice       string
+	IsGroup     bool
+	BotUsername string
+	// Allowed tells if the sender may talk to the bot at all, set by the auth stage
+	Allowed bool
+	// Allow checks a single permission of the sender, set by the auth stage,
+	// everything is denied before it
+	Allow func(def.Permission) bool
+
+	values map[string]any
+}
+
+func (ctx *Context) Reply(text string) {
+	ctx.Chat.ReplyMessage(text, ctx.Message.GetID())
+}
+
+// Set stores a value for later stages
+func (ctx *Context) Set(key string, value any) {
+	if ctx.values == nil {
+		ctx.values = make(map[string]any)
+	}
+	ctx.values[key] = value
+}
+
+func (ctx *Context) Get(key string) (any, bool) {
+	value, exists := ctx.values[key]
+	return value, exists
+}
+
+// Next runs the rest of the pipeline, a stage that doesn't call it ends the handling
+type Next func()
+
+type Stage interface {
+	Name() string
+	Handle(ctx *Context, next Next)
+}
+
+type funcStage struct {
+	name   string
+	handle func(*Context, Next)
+}
+
+func (s *funcStage) Name() string {
+	return s.name
+}
+
+func (s *funcStage) Handle(ctx *Context, next Next) {
+	s.handle(ctx, next)
+}
+
+func NewStage(name string, handle func(*Context, Next)) Stage {
+	return &funcStage{
+		name:   name,
+		handle: handle,
+	}
+}
+
+type Pipeline struct {
+	stages []Stage
+}
+
+func New(stages ...Stage) *Pipeline {
+	return &Pipeline{
+		stages: stages,
+	}
+}
+
+func (p *Pipeline) Run(ctx *Context) {
+	p.run(ctx, 0)
+}
+
+func (p *Pipeline) run(ctx *Context, i int) {
+	if i >= len(p.stages) {
+		return
+	}
+	p.stages[i].Handle(ctx, func() {
+		p.run(ctx, i+1)
+	})
+}
+
+func (p *Pipeline) Stages() []string {
+	var names []string
+	for _, stage := range p.stages {
+		names = append(names, stage.Name())
+	}
+	return names
+}
+
+var registryGuard sync.Mutex
+var registry = make(map[string]Stage)
+
+// RegisterStage makes a stage from another package available by name in the
+// pipeline configuration, call it in init() like command plugins do
+func RegisterStage(stage Stage) {
+	registryGuard.Lock()
+	defer registryGuard.Unlock()
+
+	registry[stage.Name()] = stage
+}
+
+func LookupStage(name string) Stage {
+	registryGuard.Lock()
+	defer registryGuard.Unlock()
+
+	return registry[name]
+}
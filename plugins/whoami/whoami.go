@@ -0,0 +1,40 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+// Package whoami is a small plugin that tells users the ids to put into acl.yml.
+package whoami
+
+import (
+	"fmt"
+
+	"chloe/command"
+)
+
+type whoamiPlugin struct{}
+
+func init() {
+	command.RegisterPlugin(whoamiPlugin{})
+}
+
+func (whoamiPlugin) Name() string {
+	return "whoami"
+}
+
+func (whoamiPlugin) Commands() []*command.Command {
+	return []*command.Command{
+		{
+			Name:    "id",
+			Help:    "show your user id and the id of this chat",
+			Handler: idCommand,
+		},
+	}
+}
+
+func idCommand(ctx *command.Context) {
+	ctx.Reply(fmt.Sprintf(
+		"Your user id: %s\nThis chat id: %s",
+		ctx.User.GetID().String(),
+		ctx.Chat.GetID().String(),
+	))
+}
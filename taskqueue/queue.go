@@ -0,0 +1,242 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"chloe/metrics"
+)
+
+const (
+	defaultWorkers       = 3
+	defaultQueueSize     = 100
+	defaultChatQueueSize = 10
+	defaultTimeout       = 5 * time.Minute
+)
+
+var (
+	// ErrBusy is returned when the queue or the queue of the chat is full
+	ErrBusy = errors.New("too many messages waiting")
+	// ErrClosed is returned once the queue stopped taking tasks
+	ErrClosed = errors.New("queue is closed")
+)
+
+// Config is the tasks section of config.yml
+type Config struct {
+	// tasks running at the same time, 3 by default
+	Workers int `yaml:"workers"`
+	// tasks waiting in all chats, 100 by default
+	QueueSize int `yaml:"queueSize"`
+	// tasks waiting in one chat, 10 by default
+	ChatQueueSize int `yaml:"chatQueueSize"`
+	// seconds a task may run before its ctx is canceled, 300 by default
+	Timeout int `yaml:"timeout"`
+}
+
+// Validate reports every value the queue can't run with, prefixed by the yaml path
+func (c Config) Validate(prefix string) []string {
+	var problems []string
+	for name, value := range map[string]int{
+		"workers":       c.Workers,
+		"queueSize":     c.QueueSize,
+		"chatQueueSize": c.ChatQueueSize,
+		"timeout":       c.Timeout,
+	} {
+		if value < 0 {
+			problems = append(problems, fmt.Sprintf("%s%s: %d is negative", prefix, name, value))
+		}
+	}
+	return problems
+}
+
+type Priority int
+
+const (
+	Normal Priority = iota
+	// High tasks run before the normal ones waiting in other chats
+	// and are not turned away when the queue is full
+	High
+
+	priorities = 2
+)
+
+// Task is one message to handle, ctx is done when it runs out of time or the work is canceled
+type Task func(ctx context.Context)
+
+type entry struct {
+	task     Task
+	priority Priority
+}
+
+// Queue runs tasks on a fixed number of workers. Tasks of one key, like a chat,
+// run one at a time in the order they came, tasks of different keys in parallel.
+type Queue struct {
+	workers       int
+	queueSize     int
+	chatQueueSize int
+	timeout       time.Duration
+
+	guard sync.Mutex
+	// signaled when a key gets ready or the queue is closed
+	wakeup *sync.Cond
+	// tasks waiting by key, the first one runs next
+	pending map[string][]entry
+	// keys with a task running
+	running map[string]bool
+	// keys with waiting tasks and none running, by the priority of their first task
+	ready   [priorities][]string
+	waiting int
+	closed  bool
+	done    sync.WaitGroup
+}
+
+func NewQueue(cfg Config) *Queue {
+	q := &Queue{
+		workers:       cfg.Workers,
+		queueSize:     cfg.QueueSize,
+		chatQueueSize: cfg.ChatQueueSize,
+		timeout:       time.Duration(cfg.Timeout) * time.Second,
+		pending:       make(map[string][]entry),
+		running:       make(map[string]bool),
+	}
+	if q.workers == 0 {
+		q.workers = defaultWorkers
+	}
+	if q.queueSize == 0 {
+		q.queueSize = defaultQueueSize
+	}
+	if q.chatQueueSize == 0 {
+		q.chatQueueSize = defaultChatQueueSize
+	}
+	if q.timeout == 0 {
+		q.timeout = defaultTimeout
+	}
+	q.wakeup = sync.NewCond(&q.guard)
+	return q
+}
+
+// Start runs the workers, the ctx of every task is derived from work
+func (q *Queue) Start(work context.Context) {
+	for i := 0; i < q.workers; i++ {
+		q.done.Add(1)
+		go q.worker(work)
+	}
+}
+
+// Submit queues the task behind the others of the key, it never blocks.
+// It fails with ErrBusy when too many tasks are waiting.
+func (q *Queue) Submit(key string, priority Priority, task Task) error {
+	q.guard.Lock()
+	defer q.guard.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if len(q.pending[key]) >= q.chatQueueSize || (q.waiting >= q.queueSize && priority < High) {
+		metrics.TaskRejected()
+		return ErrBusy
+	}
+
+	q.pending[key] = append(q.pending[key], entry{task: task, priority: priority})
+	q.waiting++
+	metrics.TaskQueued()
+	if len(q.pending[key]) == 1 && !q.running[key] {
+		q.ready[priority] = append(q.ready[priority], key)
+		q.wakeup.Signal()
+	}
+	return nil
+}
+
+// Close stops taking tasks and returns when the waiting and running ones are done
+func (q *Queue) Close() {
+	q.guard.Lock()
+	q.closed = true
+	q.wakeup.Broadcast()
+	q.guard.Unlock()
+
+	q.done.Wait()
+}
+
+func (q *Queue) worker(work context.Context) {
+	defer q.done.Done()
+
+	for {
+		key, e, ok := q.next()
+		if !ok {
+			return
+		}
+		q.run(work, key, e)
+		q.finish(key)
+	}
+}
+
+// next takes the first task of the most urgent ready key, it waits while none is ready
+// and fails once the queue is closed and nothing waits anymore
+func (q *Queue) next() (string, entry, bool) {
+	q.guard.Lock()
+	defer q.guard.Unlock()
+
+	for {
+		for p := priorities - 1; p >= 0; p-- {
+			if len(q.ready[p]) == 0 {
+				continue
+			}
+			key := q.ready[p][0]
+			q.ready[p] = q.ready[p][1:]
+
+			e := q.pending[key][0]
+			q.pending[key] = q.pending[key][1:]
+			q.waiting--
+			q.running[key] = true
+			return key, e, true
+		}
+		if q.closed && q.waiting == 0 {
+			// others may be waiting for the same
+			q.wakeup.Broadcast()
+			return "", entry{}, false
+		}
+		q.wakeup.Wait()
+	}
+}
+
+// finish lets the next task of the key run
+func (q *Queue) finish(key string) {
+	q.guard.Lock()
+	defer q.guard.Unlock()
+
+	delete(q.running, key)
+	if rest := q.pending[key]; len(rest) > 0 {
+		q.ready[rest[0].priority] = append(q.ready[rest[0].priority], key)
+		q.wakeup.Signal()
+	} else {
+		delete(q.pending, key)
+		if q.closed && q.waiting == 0 {
+			q.wakeup.Broadcast()
+		}
+	}
+}
+
+func (q *Queue) run(work context.Context, key string, e entry) {
+	ctx, cancel := context.WithTimeout(work, q.timeout)
+	defer cancel()
+	metrics.TaskStarted()
+	defer metrics.TaskDone()
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("task panicked", "key", key, "panic", r)
+		}
+	}()
+
+	e.task(ctx)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.Warn("task ran out of time", "key", key, "timeout", q.timeout)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitTimeout bounds every wait of the tests, so a broken queue fails instead of hanging
+const waitTimeout = 5 * time.Second
+
+func TestKeyRunsInOrder(t *testing.T) {
+	q := NewQueue(Config{Workers: 4, ChatQueueSize: 50})
+	var guard sync.Mutex
+	var order []int
+	for i := 0; i < 50; i++ {
+		i := i
+		if err := q.Submit("chat", Normal, func(ctx context.Context) {
+			guard.Lock()
+			order = append(order, i)
+			guard.Unlock()
+		}); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+	}
+	q.Start(context.Background())
+	q.Close()
+
+	if len(order) != 50 {
+		t.Fatalf("ran %d tasks, want 50", len(order))
+	}
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("task %d ran as the %dth", got, i)
+		}
+	}
+}
+
+func TestKeysRunInParallel(t *testing.T) {
+	q := NewQueue(Config{Workers: 2})
+	q.Start(context.Background())
+	defer q.Close()
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	for _, key := range []string{"a", "b"} {
+		key := key
+		if err := q.Submit(key, Normal, func(ctx context.Context) {
+			started <- key
+			<-release
+		}); err != nil {
+			t.Fatalf("submit %s: %v", key, err)
+		}
+	}
+
+	// both run at once, neither finishes before the other started
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(waitTimeout):
+			t.Fatalf("only %d of 2 keys running", i)
+		}
+	}
+	close(release)
+}
+
+func TestOneAtATimePerKey(t *testing.T) {
+	q := NewQueue(Config{Workers: 4})
+	q.Start(context.Background())
+
+	var guard sync.Mutex
+	running, most := 0, 0
+	for i := 0; i < 10; i++ {
+		if err := q.Submit("chat", Normal, func(ctx context.Context) {
+			guard.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			guard.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			guard.Lock()
+			running--
+			guard.Unlock()
+		}); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+	}
+	q.Close()
+
+	if most != 1 {
+		t.Errorf("%d tasks of one key ran at once, want 1", most)
+	}
+}
+
+func TestChatLimit(t *testing.T) {
+	q := NewQueue(Config{ChatQueueSize: 2})
+	noop := func(ctx context.Context) {}
+
+	for i := 0; i < 2; i++ {
+		if err := q.Submit("a", Normal, noop); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+	}
+	if err := q.Submit("a", Normal, noop); !errors.Is(err, ErrBusy) {
+		t.Errorf("third task of a chat: got %v, want ErrBusy", err)
+	}
+	// the chat limit holds for admins too
+	if err := q.Submit("a", High, noop); !errors.Is(err, ErrBusy) {
+		t.Errorf("third high task of a chat: got %v, want ErrBusy", err)
+	}
+	if err := q.Submit("b", Normal, noop); err != nil {
+		t.Errorf("another chat: got %v, want it queued", err)
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+	q := NewQueue(Config{QueueSize: 2})
+	noop := func(ctx context.Context) {}
+
+	for _, key := range []string{"a", "b"} {
+		if err := q.Submit(key, Normal, noop); err != nil {
+			t.Fatalf("submit %s: %v", key, err)
+		}
+	}
+	if err := q.Submit("c", Normal, noop); !errors.Is(err, ErrBusy) {
+		t.Errorf("normal task over the limit: got %v, want ErrBusy", err)
+	}
+	if err := q.Submit("c", High, noop); err != nil {
+		t.Errorf("high task over the limit: got %v, want it queued", err)
+	}
+}
+
+func TestHighRunsFirst(t *testing.T) {
+	q := NewQueue(Config{Workers: 1})
+	var order []string
+	for _, s := range []struct {
+		key      string
+		priority Priority
+	}{
+		{"a", Normal},
+		{"b", Normal},
+		{"admin", High},
+	} {
+		key := s.key
+		if err := q.Submit(key, s.priority, func(ctx context.Context) {
+			order = append(order, key)
+		}); err != nil {
+			t.Fatalf("submit %s: %v", key, err)
+		}
+	}
+	q.Start(context.Background())
+	q.Close()
+
+	if len(order) != 3 || order[0] != "admin" {
+		t.Errorf("ran %v, want admin first", order)
+	}
+}
+
+func TestCloseDrains(t *testing.T) {
+	q := NewQueue(Config{Workers: 2})
+	var guard sync.Mutex
+	ran := 0
+	for i := 0; i < 20; i++ {
+		key := []string{"a", "b", "c"}[i%3]
+		if err := q.Submit(key, Normal, func(ctx context.Context) {
+			time.Sleep(time.Millisecond)
+			guard.Lock()
+			ran++
+			guard.Unlock()
+		}); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+	}
+	q.Start(context.Background())
+
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(waitTimeout):
+		t.Fatal("close did not return")
+	}
+
+	if ran != 20 {
+		t.Errorf("close returned after %d of 20 tasks", ran)
+	}
+	if err := q.Submit("a", High, func(ctx context.Context) {}); !errors.Is(err, ErrClosed) {
+		t.Errorf("submit after close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestTimeoutCancels(t *testing.T) {
+	q := NewQueue(Config{})
+	q.timeout = 20 * time.Millisecond
+	q.Start(context.Background())
+
+	result := make(chan error, 1)
+	if err := q.Submit("a", Normal, func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+			result <- ctx.Err()
+		case <-time.After(waitTimeout):
+			result <- nil
+		}
+	}); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	q.Close()
+
+	if err := <-result; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("task ctx ended with %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestWorkCancels(t *testing.T) {
+	q := NewQueue(Config{})
+	work, cancel := context.WithCancel(context.Background())
+	q.Start(work)
+
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	if err := q.Submit("a", Normal, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		result <- ctx.Err()
+	}); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	<-started
+	cancel()
+	q.Close()
+
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Errorf("task ctx ended with %v, want Canceled", err)
+	}
+}
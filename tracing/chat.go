@@ -0,0 +1,89 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package tracing
+
+import (
+	"context"
+
+	"chloe/def"
+)
+
+// send kinds, the same as the metrics
+const (
+	kindText  = "text"
+	kindImage = "image"
+	kindVoice = "voice"
+	kindFile  = "file"
+)
+
+// Chat wraps chat so every reply sent to it is a span under the span in ctx,
+// the wrapper has buttons only if chat has. Chat actions pass through, they
+// are no-ops for chats without them.
+func Chat(ctx context.Context, chat def.Chat) def.Chat {
+	traced := &tracedChat{Chat: chat, ctx: ctx}
+	if bc, ok := chat.(def.ButtonChat); ok {
+		return &tracedButtonChat{tracedChat: traced, buttons: bc}
+	}
+	return traced
+}
+
+type tracedChat struct {
+	def.Chat
+	ctx context.Context
+}
+
+func (c *tracedChat) send(kind string, send func()) {
+	_, span := Start(c.ctx, "send reply", KeyChat.String(c.GetID().String()), KeyKind.String(kind))
+	defer span.End()
+	send()
+}
+
+func (c *tracedChat) SendMessage(m string) {
+	c.send(kindText, func() { c.Chat.SendMessage(m) })
+}
+
+func (c *tracedChat) ReplyMessage(m string, to def.MessageID) {
+	c.send(kindText, func() { c.Chat.ReplyMessage(m, to) })
+}
+
+func (c *tracedChat) QuoteMessage(m string, to def.MessageID, quote string) {
+	c.send(kindText, func() { c.Chat.QuoteMessage(m, to, quote) })
+}
+
+func (c *tracedChat) ReplyImage(img string, to def.MessageID) {
+	c.send(kindImage, func() { c.Chat.ReplyImage(img, to) })
+}
+
+func (c *tracedChat) ReplyVoice(aud string, to def.MessageID) {
+	c.send(kindVoice, func() { c.Chat.ReplyVoice(aud, to) })
+}
+
+func (c *tracedChat) ReplyFile(file string, to def.MessageID) {
+	c.send(kindFile, func() { c.Chat.ReplyFile(file, to) })
+}
+
+func (c *tracedChat) StartAction(action def.ChatAction) func() {
+	if ac, ok := c.Chat.(def.ActionChat); ok {
+		return ac.StartAction(action)
+	}
+	return func() {}
+}
+
+type tracedButtonChat struct {
+	*tracedChat
+	buttons def.ButtonChat
+}
+
+func (c *tracedButtonChat) SendButtons(m string, buttons [][]def.Button) {
+	c.send(kindText, func() { c.buttons.SendButtons(m, buttons) })
+}
+
+func (c *tracedButtonChat) ReplyButtons(m string, to def.MessageID, buttons [][]def.Button) {
+	c.send(kindText, func() { c.buttons.ReplyButtons(m, to, buttons) })
+}
+
+func (c *tracedButtonChat) EditMessage(id def.MessageID, m string) {
+	c.send(kindText, func() { c.buttons.EditMessage(id, m) })
+}
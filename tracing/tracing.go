@@ -0,0 +1,128 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultServiceName = "chloe"
+
+// attribute keys of the spans, the same as the log keys where they mean the same
+const (
+	KeyRequest = attribute.Key("chloe.req")
+	KeyBot     = attribute.Key("chloe.bot")
+	KeyUser    = attribute.Key("chloe.user")
+	KeyChat    = attribute.Key("chloe.chat")
+	KeyAdapter = attribute.Key("chloe.adapter")
+	KeyModel   = attribute.Key("chloe.model")
+	KeyKind    = attribute.Key("chloe.kind")
+)
+
+// Config is the tracing section of config.yml
+type Config struct {
+	// host:port of an OTLP gRPC collector like "localhost:4317", empty for no tracing.
+	// the OTEL_EXPORTER_OTLP_* variables like headers apply too.
+	Endpoint string `yaml:"endpoint"`
+	// send without TLS, for a collector next to the bot
+	Insecure bool `yaml:"insecure"`
+	// share of messages traced from 0 to 1, all of them if 0
+	SampleRatio float64 `yaml:"sampleRatio"`
+	// service.name of the spans, chloe by default
+	ServiceName string `yaml:"serviceName"`
+}
+
+// Validate reports every value the tracer can't run with, prefixed by the yaml path
+func (c Config) Validate(prefix string) []string {
+	var problems []string
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		problems = append(problems, fmt.Sprintf("%ssampleRatio: %v is not between 0 and 1", prefix, c.SampleRatio))
+	}
+	return problems
+}
+
+var tracer = otel.Tracer("chloe")
+
+// Setup exports spans to the configured collector, spans are dropped without an endpoint.
+// The returned func flushes the spans not sent yet and stops exporting.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the trace exporter, %v", err)
+	}
+
+	name := cfg.ServiceName
+	if name == "" {
+		name = defaultServiceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the service, %v", err)
+	}
+
+	ratio := cfg.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("tracing failed", "err", err)
+	}))
+	slog.Info("tracing exported", "endpoint", cfg.Endpoint, "sampleRatio", ratio)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span under the span in ctx, the returned ctx carries the new span
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, marking it failed if err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Continue returns ctx with the span of from as its parent span, for work that goes on
+// in another goroutine than the one that started the trace
+func Continue(ctx, from context.Context) context.Context {
+	return trace.ContextWithSpanContext(ctx, trace.SpanContextFromContext(from))
+}
+
+// TraceID is the id of the trace in ctx, empty if it is not traced or not sampled
+func TraceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() && sc.IsSampled() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
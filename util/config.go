@@ -5,98 +5,510 @@
 package util
 
 import (
-	"chloe/def"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"chloe/logging"
+	"chloe/media"
+	"chloe/taskqueue"
+	"chloe/tracing"
 
-	log "github.com/jeanphorn/log4go"
 	"gopkg.in/yaml.v3"
 )
 
 const (
-	allowAll = "allow_all"
+	// quota group of everyone not in another group
+	DefaultGroup = "default"
 )
 
 type Config struct {
+	// Path is the file the config is loaded from
+	Path string `yaml:"-"`
+	// Instance is the name of the bot in bots, empty for the top level bot
+	Instance string `yaml:"-"`
+
 	BotName string `yaml:"botName"`
-	OpenAI  struct {
-		APIKey         string `yaml:"apiKey"`
-		Model          string `yaml:"model"`
-		ContextTimeout int    `yaml:"contextTimeout"`
-	} `yaml:"openAI"`
-	Telegram struct {
-		BotToken string `yaml:"botToken"`
-	} `yaml:"telegram"`
+	// Persona is the system prompt, a generic assistant by default
+	Persona  string           `yaml:"persona"`
+	OpenAI   OpenAIConfig     `yaml:"openAI"`
+	Telegram TelegramConfig   `yaml:"telegram"`
+	Remote   RemoteConfig     `yaml:"remote"`
+	Log      logging.Config   `yaml:"log"`
+	Tracing  tracing.Config   `yaml:"tracing"`
+	Tasks    taskqueue.Config `yaml:"tasks"`
+	Media    media.Config     `yaml:"media"`
+	Admin    struct {
+		// address of /metrics, /healthz and /readyz like ":9090", empty for none
+		Listen string `yaml:"listen"`
+	} `yaml:"admin"`
 	System struct {
-		WhitelistEnabled bool `yaml:"whitelistEnabled"`
+		WhitelistEnabled bool   `yaml:"whitelistEnabled"`
+		DataDir          string `yaml:"dataDir"`
+		TimeZone         string `yaml:"timeZone"`
+		// seconds to wait for running tasks on shutdown
+		ShutdownTimeout int `yaml:"shutdownTimeout"`
 	} `yaml:"system"`
+	Pipeline struct {
+		Stages []string `yaml:"stages"`
+	} `yaml:"pipeline"`
+	Quota     QuotaConfig     `yaml:"quota"`
+	GroupChat GroupChatConfig `yaml:"groupChat"`
+	Pricing   Pricing         `yaml:"pricing"`
+	// Bots run more bots in this process, each takes the settings above
+	// as defaults. Without bots the settings above are the only bot.
+	Bots []BotConfig `yaml:"bots"`
+	// ACL is the acl file of a bot in bots, relative to this file
+	ACL string `yaml:"-"`
 }
 
-type AccessControl struct {
-	AllowedUserID map[string]bool `yaml:"allowedUserID,omitempty"`
-	AllowedChatID map[string]bool `yaml:"allowedChatID,omitempty"`
+type OpenAIConfig struct {
+	APIKey string `yaml:"apiKey"`
+	// file with the api key, like a docker or k8s secret, wins over apiKey
+	APIKeyFile     string `yaml:"apiKeyFile"`
+	Model          string `yaml:"model"`
+	ContextTimeout int    `yaml:"contextTimeout"`
+	// models users with the model permission can switch to
+	Models []string `yaml:"models"`
 }
 
-func (acl AccessControl) AllowUser(uid def.UserID) bool {
-	allowed := acl.AllowedUserID[uid.String()]
-	if !allowed {
-		allowed = acl.AllowedUserID[allowAll] // allow all
-	}
-	return allowed
+// how spoken answers are sent to telegram
+const (
+	VoiceFormatVoice = "voice"
+	VoiceFormatAudio = "audio"
+)
+
+type TelegramConfig struct {
+	BotToken     string `yaml:"botToken"`
+	BotTokenFile string `yaml:"botTokenFile"`
+	// VoiceFormat is "voice" for voice messages, "audio" for mp3 files, voice by default
+	VoiceFormat string `yaml:"voiceFormat"`
+}
+
+type RemoteConfig struct {
+	// grpc port for remote chats, empty for none
+	Port string `yaml:"port"`
+}
+
+// threads of group chats
+const (
+	ThreadsShared = "shared"
+	ThreadsUser   = "user"
+)
+
+// GroupChatConfig is how the bot talks in group chats
+type GroupChatConfig struct {
+	// Threads is "shared" for one conversation per group, "user" for one per member, shared by default
+	Threads string `yaml:"threads"`
+	// Passive keeps the messages not addressed to the bot as background for the next question,
+	// telegram only sends them with the privacy mode of the bot disabled in BotFather
+	Passive bool `yaml:"passive"`
+	// PassiveWindow is how many of them are kept per group, 20 by default
+	PassiveWindow int `yaml:"passiveWindow"`
+}
+
+type QuotaConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// limits by ACL group, "default" is for everyone not in a group
+	Groups map[string]QuotaGroup `yaml:"groups"`
+}
+
+// BotConfig is one bot in bots, empty settings are taken from the top level
+type BotConfig struct {
+	// Name tells the bots apart in logs and data dirs
+	Name     string         `yaml:"name"`
+	BotName  string         `yaml:"botName"`
+	Persona  string         `yaml:"persona"`
+	OpenAI   OpenAIConfig   `yaml:"openAI"`
+	Telegram TelegramConfig `yaml:"telegram"`
+	Remote   RemoteConfig   `yaml:"remote"`
+	// ACL is the acl file of the bot, the acl given on the command line by default
+	ACL       string           `yaml:"acl"`
+	Quota     *QuotaConfig     `yaml:"quota"`
+	GroupChat *GroupChatConfig `yaml:"groupChat"`
+}
+
+// Pricing is the price table for the usage report
+type Pricing struct {
+	Currency string `yaml:"currency"`
+	// per 1K tokens by chat model
+	Models map[string]ModelPrice `yaml:"models"`
+	// per minute by transcription model
+	AudioPerMinute map[string]float64 `yaml:"audioPerMinute"`
+	// per image by size like 512x512
+	Images map[string]float64 `yaml:"images"`
+}
+
+type ModelPrice struct {
+	Prompt     float64 `yaml:"prompt"`
+	Completion float64 `yaml:"completion"`
+}
+
+// QuotaAmount counts what is used, as a limit 0 means unlimited
+type QuotaAmount struct {
+	Messages     int     `yaml:"messages" json:"messages"`
+	Tokens       int     `yaml:"tokens" json:"tokens"`
+	Images       int     `yaml:"images" json:"images"`
+	AudioSeconds float64 `yaml:"audioSeconds" json:"audioSeconds"`
 }
 
-func (acl AccessControl) AllowChat(cid def.ChatID) bool {
-	allowed := acl.AllowedChatID[cid.String()]
-	if !allowed {
-		allowed = acl.AllowedChatID[allowAll] // allow all
+type QuotaLimits struct {
+	// token bucket refill rate and size, 0 means no rate limit
+	RatePerMinute float64     `yaml:"ratePerMinute"`
+	Burst         int         `yaml:"burst"`
+	Daily         QuotaAmount `yaml:"daily"`
+	Monthly       QuotaAmount `yaml:"monthly"`
+}
+
+type QuotaGroup struct {
+	User QuotaLimits `yaml:"user"`
+	Chat QuotaLimits `yaml:"chat"`
+}
+
+// DefaultPath finds a file next to the executable, then in the working directory,
+// so both an installed binary and go run find config.yml
+func DefaultPath(name string) string {
+	if exe, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(exe), name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
 	}
-	return allowed
+	return name
 }
 
-func ReadConfig() Config {
-	exe, err := os.Executable()
+// ConfigError lists every problem found in a config
+type ConfigError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config %s: %s", e.Path, strings.Join(e.Problems, "; "))
+}
+
+// LoadConfig reads the config file, applies CHLOE_ environment overrides and
+// secret files, then validates the result
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	configFile, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return config, err
 	}
-	exPath := filepath.Dir(exe)
-	configPath := filepath.Join(exPath, "config.yml")
 
-	configFile, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		log.Error("fail to ready config file %s, %v", configPath, err)
-		panic(err)
+	decoder := yaml.NewDecoder(bytes.NewReader(configFile))
+	// a misspelled key is an error, not a silently missing setting
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return config, &ConfigError{Path: path, Problems: yamlProblems(err)}
 	}
+	config.Path = path
 
-	var config Config
-	err = yaml.Unmarshal(configFile, &config)
-	if err != nil {
-		log.Error("fail to parse config file %s, %v", configPath, err)
-		panic(err)
+	var problems []string
+	problems = append(problems, applyEnv(reflect.ValueOf(&config).Elem(), EnvPrefix)...)
+	problems = append(problems, readSecret(&config.OpenAI, &config.Telegram, "")...)
+	for i := range config.Bots {
+		bot := &config.Bots[i]
+		problems = append(problems, readSecret(&bot.OpenAI, &bot.Telegram, fmt.Sprintf("bots[%d].", i))...)
+	}
+	if err := config.Validate(); err != nil {
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			return config, err
+		}
+		problems = append(problems, configErr.Problems...)
 	}
+	if len(problems) > 0 {
+		return config, &ConfigError{Path: path, Problems: problems}
+	}
+	return config, nil
+}
 
-	return config
+// yamlProblems splits a decoding error into one problem per field
+func yamlProblems(err error) []string {
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		return typeErr.Errors
+	}
+	return []string{err.Error()}
 }
 
-func ReadAccessList() AccessControl {
-	exe, err := os.Executable()
-	if err != nil {
-		panic(err)
+// readSecret replaces the api key and bot token by the content of their files, if given
+func readSecret(openAI *OpenAIConfig, telegram *TelegramConfig, prefix string) []string {
+	var problems []string
+	for _, secret := range []struct {
+		value *string
+		file  string
+		field string
+	}{
+		{&openAI.APIKey, openAI.APIKeyFile, "openAI.apiKeyFile"},
+		{&telegram.BotToken, telegram.BotTokenFile, "telegram.botTokenFile"},
+	} {
+		if secret.file == "" {
+			continue
+		}
+		content, err := os.ReadFile(secret.file)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s%s: %v", prefix, secret.field, err))
+			continue
+		}
+		*secret.value = strings.TrimSpace(string(content))
 	}
-	exPath := filepath.Dir(exe)
-	aclPath := filepath.Join(exPath, "acl.yml")
+	return problems
+}
 
-	aclFile, err := ioutil.ReadFile(aclPath)
-	if err != nil {
-		log.Error("fail to ready acl file %s, %v", aclPath, err)
-		panic(err)
+// Instances returns the config of every bot to run. A bot in bots takes the top level
+// settings it leaves empty, except the adapter credentials and the acl.
+func (c Config) Instances() []Config {
+	if len(c.Bots) == 0 {
+		return []Config{c}
 	}
 
-	var acl AccessControl
-	err = yaml.Unmarshal(aclFile, &acl)
-	if err != nil {
-		log.Error("fail to parse acl file %s, %v", aclPath, err)
-		panic(err)
+	var instances []Config
+	for _, bot := range c.Bots {
+		inst := c
+		inst.Bots = nil
+		inst.Instance = bot.Name
+		inst.Telegram = bot.Telegram
+		if inst.Telegram.VoiceFormat == "" {
+			inst.Telegram.VoiceFormat = c.Telegram.VoiceFormat
+		}
+		inst.Remote = bot.Remote
+		inst.ACL = bot.ACL
+		if inst.ACL != "" && !filepath.IsAbs(inst.ACL) && c.Path != "" {
+			inst.ACL = filepath.Join(filepath.Dir(c.Path), inst.ACL)
+		}
+		if bot.BotName != "" {
+			inst.BotName = bot.BotName
+		}
+		if bot.Persona != "" {
+			inst.Persona = bot.Persona
+		}
+		if bot.OpenAI.APIKey != "" {
+			inst.OpenAI.APIKey = bot.OpenAI.APIKey
+		}
+		if bot.OpenAI.Model != "" {
+			inst.OpenAI.Model = bot.OpenAI.Model
+		}
+		if bot.OpenAI.ContextTimeout != 0 {
+			inst.OpenAI.ContextTimeout = bot.OpenAI.ContextTimeout
+		}
+		if len(bot.OpenAI.Models) > 0 {
+			inst.OpenAI.Models = bot.OpenAI.Models
+		}
+		if bot.Quota != nil {
+			inst.Quota = *bot.Quota
+		}
+		if bot.GroupChat != nil {
+			inst.GroupChat = *bot.GroupChat
+		}
+		instances = append(instances, inst)
+	}
+	return instances
+}
+
+// Secrets returns the api keys and bot tokens of all bots, to keep them out of the log
+func (c Config) Secrets() []string {
+	var secrets []string
+	for _, inst := range c.Instances() {
+		secrets = append(secrets, inst.OpenAI.APIKey, inst.Telegram.BotToken)
+	}
+	return secrets
+}
+
+// Bot returns the config of the bot with the name, "" for the top level bot
+func (c Config) Bot(name string) (Config, bool) {
+	for _, inst := range c.Instances() {
+		if inst.Instance == name {
+			return inst, true
+		}
+	}
+	return Config{}, false
+}
+
+var (
+	botTokenPattern     = regexp.MustCompile(`^[0-9]+:[A-Za-z0-9_-]+$`)
+	instanceNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+// Validate reports every value the bot can't run with, by its yaml path
+func (c *Config) Validate() error {
+	var errs []string
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.System.TimeZone != "" {
+		if _, err := time.LoadLocation(c.System.TimeZone); err != nil {
+			fail("system.timeZone: %v", err)
+		}
+	}
+	errs = append(errs, c.Log.Validate("log.")...)
+	errs = append(errs, c.Tracing.Validate("tracing.")...)
+	errs = append(errs, c.Tasks.Validate("tasks.")...)
+	errs = append(errs, c.Media.Validate("media.")...)
+	if c.Admin.Listen != "" {
+		if _, port, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			fail("admin.listen: %v", err)
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			fail("admin.listen: '%s' is not a port number", port)
+		}
+	}
+	if c.System.ShutdownTimeout < 0 {
+		fail("system.shutdownTimeout: %d seconds is negative", c.System.ShutdownTimeout)
+	}
+
+	seen := make(map[string]bool)
+	for i, stage := range c.Pipeline.Stages {
+		if stage == "" {
+			fail("pipeline.stages[%d]: must not be empty", i)
+		} else if seen[stage] {
+			fail("pipeline.stages[%d]: %s is listed twice", i, stage)
+		}
+		seen[stage] = true
+	}
+	// the stages after auth rely on it to check permissions
+	if len(c.Pipeline.Stages) > 0 && !seen["auth"] {
+		fail("pipeline.stages: auth is missing, nobody's permissions would be checked")
+	}
+
+	validateQuota("quota", c.Quota, fail)
+	validateGroupChat("groupChat", c.GroupChat, fail)
+	for i, bot := range c.Bots {
+		if bot.Quota != nil {
+			validateQuota(fmt.Sprintf("bots[%d].quota", i), *bot.Quota, fail)
+		}
+		if bot.GroupChat != nil {
+			validateGroupChat(fmt.Sprintf("bots[%d].groupChat", i), *bot.GroupChat, fail)
+		}
+	}
+
+	for model, price := range c.Pricing.Models {
+		if price.Prompt < 0 || price.Completion < 0 {
+			fail("pricing.models.%s: prices must not be negative", model)
+		}
+	}
+	for model, price := range c.Pricing.AudioPerMinute {
+		if price < 0 {
+			fail("pricing.audioPerMinute.%s: %g is negative", model, price)
+		}
+	}
+	for size, price := range c.Pricing.Images {
+		if price < 0 {
+			fail("pricing.images.%s: %g is negative", size, price)
+		}
+	}
+
+	names := make(map[string]bool)
+	tokens := make(map[string]string)
+	ports := make(map[string]string)
+	for i, inst := range c.Instances() {
+		prefix := ""
+		if len(c.Bots) > 0 {
+			prefix = fmt.Sprintf("bots[%d].", i)
+			if !instanceNamePattern.MatchString(inst.Instance) {
+				fail("%sname: '%s' must be 1 to 32 of a-z, 0-9, _ and -", prefix, inst.Instance)
+			} else if names[inst.Instance] {
+				fail("%sname: %s is used twice", prefix, inst.Instance)
+			}
+			names[inst.Instance] = true
+		}
+		validateInstance(prefix, inst, fail)
+
+		if token := inst.Telegram.BotToken; token != "" {
+			if other, used := tokens[token]; used {
+				fail("%stelegram.botToken: already used by %s", prefix, other)
+			}
+			tokens[token] = prefix + "telegram"
+		}
+		if port := inst.Remote.Port; port != "" {
+			if other, used := ports[port]; used {
+				fail("%sremote.port: %s is already used by %s", prefix, port, other)
+			}
+			ports[port] = prefix + "remote"
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return &ConfigError{Path: c.Path, Problems: errs}
+	}
+	return nil
+}
+
+func validateInstance(prefix string, inst Config, fail func(string, ...any)) {
+	if strings.TrimSpace(inst.BotName) == "" {
+		fail("%sbotName: must not be empty", prefix)
+	}
+	if inst.OpenAI.APIKey == "" {
+		fail("%sopenAI.apiKey: must be set, or openAI.apiKeyFile, or %sOPENAI_APIKEY", prefix, EnvPrefix)
+	}
+	if inst.OpenAI.Model == "" {
+		fail("%sopenAI.model: must not be empty", prefix)
+	}
+	if inst.OpenAI.ContextTimeout < 0 {
+		fail("%sopenAI.contextTimeout: %d seconds is negative", prefix, inst.OpenAI.ContextTimeout)
+	}
+	for i, m := range inst.OpenAI.Models {
+		if strings.TrimSpace(m) == "" {
+			fail("%sopenAI.models[%d]: must not be empty", prefix, i)
+		}
+	}
+	if inst.Telegram.BotToken == "" && inst.Remote.Port == "" {
+		fail("%stelegram.botToken: must be set, or telegram.botTokenFile, or remote.port", prefix)
+	} else if inst.Telegram.BotToken != "" && !botTokenPattern.MatchString(inst.Telegram.BotToken) {
+		fail("%stelegram.botToken: does not look like <bot id>:<secret> from BotFather", prefix)
+	}
+	switch inst.Telegram.VoiceFormat {
+	case "", VoiceFormatVoice, VoiceFormatAudio:
+	default:
+		fail("%stelegram.voiceFormat: '%s' is not %s or %s", prefix, inst.Telegram.VoiceFormat, VoiceFormatVoice, VoiceFormatAudio)
+	}
+	if _, err := strconv.ParseUint(inst.Remote.Port, 10, 16); inst.Remote.Port != "" && err != nil {
+		fail("%sremote.port: '%s' is not a port number", prefix, inst.Remote.Port)
+	}
+}
+
+func validateQuota(prefix string, quota QuotaConfig, fail func(string, ...any)) {
+	for name, group := range quota.Groups {
+		for scope, limits := range map[string]QuotaLimits{"user": group.User, "chat": group.Chat} {
+			field := fmt.Sprintf("%s.groups.%s.%s", prefix, name, scope)
+			if limits.RatePerMinute < 0 {
+				fail("%s.ratePerMinute: %g is negative", field, limits.RatePerMinute)
+			}
+			if limits.Burst < 0 {
+				fail("%s.burst: %d is negative", field, limits.Burst)
+			}
+			for period, amount := range map[string]QuotaAmount{"daily": limits.Daily, "monthly": limits.Monthly} {
+				if amount.Messages < 0 || amount.Tokens < 0 || amount.Images < 0 || amount.AudioSeconds < 0 {
+					fail("%s.%s: limits must not be negative", field, period)
+				}
+			}
+		}
+	}
+}
+
+func validateGroupChat(prefix string, group GroupChatConfig, fail func(string, ...any)) {
+	switch group.Threads {
+	case "", ThreadsShared, ThreadsUser:
+	default:
+		fail("%s.threads: '%s' is not %s or %s", prefix, group.Threads, ThreadsShared, ThreadsUser)
+	}
+	if group.PassiveWindow < 0 {
+		fail("%s.passiveWindow: %d is negative", prefix, group.PassiveWindow)
 	}
-	return acl
 }
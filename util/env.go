@@ -0,0 +1,78 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EnvPrefix = "CHLOE_"
+
+	// a variable with this suffix names a file holding the value
+	envFileSuffix = "_FILE"
+
+	// the paths given outside the config, named so they match no setting
+	EnvConfigFile = EnvPrefix + "CONFIG_FILE"
+	EnvACLFile    = EnvPrefix + "ACL_FILE"
+	EnvLogDir     = EnvPrefix + "LOG_DIR"
+)
+
+// applyEnv overrides config fields from environment variables named by the yaml path,
+// CHLOE_OPENAI_APIKEY for openAI.apiKey. Values other than strings are yaml, so lists
+// and maps can be set as well: CHLOE_OPENAI_MODELS="[gpt-4, gpt-3.5-turbo]".
+// CHLOE_OPENAI_APIKEY_FILE reads the value from a file, for docker and k8s secrets.
+func applyEnv(v reflect.Value, prefix string) []string {
+	var problems []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" || !field.IsExported() {
+			continue
+		}
+
+		name := prefix + strings.ToUpper(tag)
+		fv := v.Field(i)
+		if err := overrideField(fv, name); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if fv.Kind() == reflect.Struct {
+			problems = append(problems, applyEnv(fv, name+"_")...)
+		}
+	}
+	return problems
+}
+
+func overrideField(fv reflect.Value, name string) error {
+	value, exists := os.LookupEnv(name)
+	if !exists {
+		file, exists := os.LookupEnv(name + envFileSuffix)
+		if !exists {
+			return nil
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name+envFileSuffix, err)
+		}
+		value = strings.TrimSpace(string(content))
+	}
+
+	if fv.Kind() == reflect.String {
+		fv.SetString(value)
+		return nil
+	}
+	target := reflect.New(fv.Type())
+	if err := yaml.Unmarshal([]byte(value), target.Interface()); err != nil {
+		return fmt.Errorf("%s: %s", name, strings.Join(yamlProblems(err), ", "))
+	}
+	fv.Set(target.Elem())
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testConfig is the least config that validates
+const testConfig = `botName: chloe
+openAI:
+  apiKey: sk-test
+  model: gpt-3.5-turbo
+telegram:
+  botToken: "1:test"
+`
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestPathEnvIsNoSetting(t *testing.T) {
+	t.Setenv(EnvConfigFile, "/etc/chloe/config.yml")
+	t.Setenv(EnvACLFile, "/etc/chloe/acl.yml")
+	t.Setenv(EnvLogDir, "/var/log/chloe")
+
+	if _, err := LoadConfig(writeTestConfig(t, testConfig)); err != nil {
+		t.Errorf("load with the path variables set: %v", err)
+	}
+}
+
+func TestEnvOverride(t *testing.T) {
+	t.Setenv("CHLOE_BOTNAME", "zoe")
+	t.Setenv("CHLOE_LOG_LEVEL", "debug")
+	t.Setenv("CHLOE_OPENAI_MODELS", "[gpt-4, gpt-3.5-turbo]")
+
+	config, err := LoadConfig(writeTestConfig(t, testConfig+"log:\n  level: info\n"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if config.BotName != "zoe" || config.Log.Level != "debug" {
+		t.Errorf("got botName %q and log.level %q, want zoe and debug", config.BotName, config.Log.Level)
+	}
+	if len(config.OpenAI.Models) != 2 {
+		t.Errorf("openAI.models: got %v, want 2 models", config.OpenAI.Models)
+	}
+
+	// a section is set as yaml, a bare path is no section
+	t.Setenv("CHLOE_LOG", "/var/log/chloe")
+	if _, err := LoadConfig(writeTestConfig(t, testConfig)); err == nil {
+		t.Error("CHLOE_LOG as a path: got no error, want the log section rejected")
+	}
+}
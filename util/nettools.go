@@ -6,21 +6,19 @@
 
 import (
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 
 	"chloe/def"
-
-	log "github.com/jeanphorn/log4go"
 )
 
 func DownloadTempFile(link string) (string, def.CleanFunc) {
 	ext := filepath.Ext(link)
 	f, err := os.CreateTemp("", "*"+ext)
 	if err != nil {
-		log.Error("creating temp file failed, %v", err)
+		slog.Error("creating temp file failed", "err", err)
 		return "", nil
 	}
 	defer f.Close()
@@ -28,45 +26,18 @@ func DownloadTempFile(link string) (string, def.CleanFunc) {
 
 	resp, err := http.Get(link)
 	if err != nil {
-		log.Error("download file %s failed, %v", link, err)
+		slog.Error("download file failed", "err", err)
+		_ = os.Remove(fpath)
 		return "", nil
 	}
 	defer resp.Body.Close()
 
 	if _, err := io.Copy(f, resp.Body); err != nil {
-		log.Error("copy file failed, %v", err)
+		slog.Error("copy file failed", "err", err)
+		_ = os.Remove(fpath)
 		return "", nil
 	}
 	return fpath, func() {
 		_ = os.Remove(fpath)
 	}
 }
-
-func ConvertToMp3(audioFile string) (string, def.CleanFunc) {
-	ext := filepath.Ext(audioFile)
-	mp3Filepath := audioFile[:len(audioFile)-1-len(ext)] + ".mp3"
-
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i",
-		audioFile,
-		"-vn",
-		"-ar",
-		"44100",
-		"-ac",
-		"2",
-		"-ab",
-		"192k",
-		"-f",
-		"mp3",
-		mp3Filepath,
-	)
-	if err := cmd.Run(); err != nil {
-		log.Error("failed to convert voice file %s to mp3, %v", audioFile, err)
-		return "", nil
-	}
-
-	return mp3Filepath, func() {
-		_ = os.Remove(mp3Filepath)
-	}
-}
@@ -0,0 +1,82 @@
+/*
+ * mastercoderk@gmail.com
+ */
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultDataDir = "data"
+)
+
+// GetDataDir returns the directory for persistent state, relative paths are
+// resolved against the directory of config.yml. Each bot in bots has a sub directory.
+func GetDataDir(config Config) string {
+	dataDir := config.System.DataDir
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	if !filepath.IsAbs(dataDir) && config.Path != "" {
+		dataDir = filepath.Join(filepath.Dir(config.Path), dataDir)
+	}
+	if config.Instance != "" {
+		dataDir = filepath.Join(dataDir, config.Instance)
+	}
+
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		slog.Error("failed to create data dir", "path", dataDir, "err", err)
+	}
+	return dataDir
+}
+
+// LoadJSON reads the json file into v, a missing file leaves v untouched
+func LoadJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// SaveJSON writes v to path atomically, the old file is only replaced after
+// the new content is completely written
+func SaveJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
+
+func WriteFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}